@@ -1,36 +1,105 @@
 package aho_corasick
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"runtime"
 	"strings"
 	"sync"
-	"unicode"
+	"unsafe"
 )
 
 type AhoCorasick struct {
-	ptr uintptr
-	abi *ahoCorasickABI
-
-	matchOnlyWholeWords bool
-	patternCount        int
+	ptr   uintptr
+	abi   *ahoCorasickABI
+	state *matcherState
+	// pool holds copies of the matcher for parallel searches, including the one in ptr and abi.
+	// It is nil when searches use ptr and abi directly.
+	pool *matcherPool
+
+	matchOnlyWholeWords    bool
+	wordBoundaries         wordBoundaries
+	unicodeCaseInsensitive bool
+	normalization          normalization
+	matchKind              matchKind
+	startKind              startKind
+	patternCount           int
+	minPatternLen          int
+	maxPatternLen          int
 }
 
 func (ac AhoCorasick) PatternCount() int {
 	return ac.patternCount
 }
 
+// Close releases the matcher and the memory backing it immediately instead of when it is garbage
+// collected. It is safe to call Close multiple times and from any copy of the AhoCorasick. After
+// closing, methods without an error result such as FindAll, IsMatch, Stats and the Next method of
+// iterators from Iter panic with ErrClosed, while FindAllContext, iterators with a context and
+// streams return ErrClosed.
+func (ac AhoCorasick) Close() error {
+	if ac.state == nil {
+		return nil
+	}
+	return ac.state.close(ac.abi, ac.ptr, ac.pool)
+}
+
+// startOperation starts an operation on the matcher, returning the copy of the matcher to use.
+// The operation must be ended with endOperation on the abi of the returned copy.
+func (ac AhoCorasick) startOperation(memorySize int) matcherInstance {
+	if ac.pool != nil {
+		return ac.pool.startOperation(memorySize)
+	}
+	ac.abi.startOperation(memorySize)
+	return matcherInstance{abi: ac.abi, ptr: ac.ptr}
+}
+
+func (ac AhoCorasick) checkUnanchored() {
+	if ac.startKind == AnchoredStart {
+		panic("unanchored searches require StartKind UnanchoredStart or BothStart")
+	}
+}
+
 // Iter gives an iterator over the built patterns
 func (ac AhoCorasick) Iter(haystack string) Iter {
+	return ac.iter(nil, haystack, 0, len(haystack))
+}
+
+// IterSpan is like Iter but only searches the span of the haystack from start to end. Offsets of matches
+// and word boundaries are relative to the entire haystack.
+func (ac AhoCorasick) IterSpan(haystack string, start int, end int) Iter {
+	return ac.iter(nil, haystack, start, end)
+}
+
+// iter returns an iterator stopping when ctx is done if it is not nil. Iterators without a context
+// cannot report that the matcher is closed with Err, so they panic with ErrClosed instead.
+func (ac AhoCorasick) iter(ctx context.Context, haystack string, start int, end int) *findIter {
+	ac.checkUnanchored()
+
+	if !ac.state.tryEnter() {
+		if ctx == nil {
+			panic(ErrClosed)
+		}
+		return &findIter{abi: ac.abi, state: ac.state, ctx: ctx, err: ErrClosed}
+	}
+	defer ac.state.exit()
+
 	// Haystack must stay alive throughout the iteration so we malloc it. Unfortunately this
 	// really slows things down.
-	ac.abi.startOperation(0)
-	defer ac.abi.endOperation()
+	inst := ac.startOperation(0)
+	defer inst.abi.endOperation()
 
-	cs := ac.abi.newOwnedCString(haystack)
+	h := ac.mapHaystack(haystack, start, end)
+	cs := inst.abi.newOwnedCString(h.s)
 
-	iterPtr := ac.abi.findIter(ac.ptr, cs)
+	iterPtr := inst.abi.findIter(inst.ptr, cs)
 
-	iter := &findIter{ptr: iterPtr, abi: ac.abi, matchOnlyWholeWords: ac.matchOnlyWholeWords, haystack: haystack, haystackPtr: cs.ptr}
+	iter := &findIter{ptr: iterPtr, abi: inst.abi, state: ac.state, words: ac.wordFilter(haystack), haystack: h, haystackPtr: cs.ptr, ctx: ctx}
+	if ac.matchOnlyWholeWords && ac.matchKind != StandardMatch {
+		iter.matcher = inst.ptr
+	}
 
 	// Use func(interface{}) form for nottinygc compatibility
 	runtime.SetFinalizer(iter, func(obj interface{}) {
@@ -42,16 +111,38 @@ func (ac AhoCorasick) Iter(haystack string) Iter {
 
 // IterOverlapping gives an iterator over the built patterns with overlapping matches
 func (ac AhoCorasick) IterOverlapping(haystack string) Iter {
+	return ac.iterOverlapping(nil, haystack, 0, len(haystack))
+}
+
+// IterOverlappingSpan is like IterOverlapping but only searches the span of the haystack from start to end.
+// Offsets of matches and word boundaries are relative to the entire haystack.
+func (ac AhoCorasick) IterOverlappingSpan(haystack string, start int, end int) Iter {
+	return ac.iterOverlapping(nil, haystack, start, end)
+}
+
+// iterOverlapping is like iter for overlapping matches.
+func (ac AhoCorasick) iterOverlapping(ctx context.Context, haystack string, start int, end int) *overlappingIter {
+	ac.checkUnanchored()
+
+	if !ac.state.tryEnter() {
+		if ctx == nil {
+			panic(ErrClosed)
+		}
+		return &overlappingIter{abi: ac.abi, state: ac.state, ctx: ctx, err: ErrClosed}
+	}
+	defer ac.state.exit()
+
 	// Haystack must stay alive throughout the iteration so we malloc it. Unfortunately this
 	// really slows things down.
-	ac.abi.startOperation(0)
-	defer ac.abi.endOperation()
+	inst := ac.startOperation(0)
+	defer inst.abi.endOperation()
 
-	cs := ac.abi.newOwnedCString(haystack)
+	h := ac.mapHaystack(haystack, start, end)
+	cs := inst.abi.newOwnedCString(h.s)
 
-	iterPtr := ac.abi.overlappingIter(ac.ptr, cs)
+	iterPtr := inst.abi.overlappingIter(inst.ptr, cs)
 
-	iter := &overlappingIter{ptr: iterPtr, abi: ac.abi, matchOnlyWholeWords: ac.matchOnlyWholeWords, haystack: haystack, haystackPtr: cs.ptr}
+	iter := &overlappingIter{ptr: iterPtr, abi: inst.abi, state: ac.state, words: ac.wordFilter(haystack), haystack: h, haystackPtr: cs.ptr, ctx: ctx}
 
 	// Use func(interface{}) form for nottinygc compatibility
 	runtime.SetFinalizer(iter, func(obj interface{}) {
@@ -60,6 +151,31 @@ func (ac AhoCorasick) IterOverlapping(haystack string) Iter {
 	return iter
 }
 
+// IterContext is like Iter but stops iterating when ctx is done, which is checked before searching for
+// each batch of matches. Once Next returns nil, Err returns ctx.Err() if the iteration was stopped early.
+func (ac AhoCorasick) IterContext(ctx context.Context, haystack string) ContextIter {
+	return ac.iter(ctx, haystack, 0, len(haystack))
+}
+
+// IterOverlappingContext is like IterOverlapping but stops iterating when ctx is done, which is checked
+// before searching for each batch of matches. Once Next returns nil, Err returns ctx.Err() if the
+// iteration was stopped early.
+func (ac AhoCorasick) IterOverlappingContext(ctx context.Context, haystack string) ContextIter {
+	return ac.iterOverlapping(ctx, haystack, 0, len(haystack))
+}
+
+// IterBytes is like Iter but takes the haystack as a byte slice, which is searched without copying
+// it into a string. The haystack must not be modified until the iterator is exhausted.
+func (ac AhoCorasick) IterBytes(haystack []byte) Iter {
+	return ac.Iter(bytesToString(haystack))
+}
+
+// IterOverlappingBytes is like IterOverlapping but takes the haystack as a byte slice, which is searched
+// without copying it into a string. The haystack must not be modified until the iterator is exhausted.
+func (ac AhoCorasick) IterOverlappingBytes(haystack []byte) Iter {
+	return ac.IterOverlapping(bytesToString(haystack))
+}
+
 var pool = sync.Pool{
 	New: func() interface{} {
 		return &strings.Builder{}
@@ -85,6 +201,32 @@ func (r Replacer) ReplaceAllFunc(haystack string, f func(match Match) (string, b
 		return haystack
 	}
 
+	str := pool.Get().(*strings.Builder)
+
+	defer func() {
+		str.Reset()
+		pool.Put(str)
+	}()
+
+	writeReplaced(str, haystack, matches, f)
+
+	return str.String()
+}
+
+// ReplaceAllFuncBytes is like ReplaceAllFunc but operates on a byte slice haystack
+// The result is always a new slice, even if nothing was replaced
+func (r Replacer) ReplaceAllFuncBytes(haystack []byte, f func(match Match) (string, bool)) []byte {
+	s := bytesToString(haystack)
+	matches := r.finder.FindAll(s)
+
+	var buf bytes.Buffer
+	buf.Grow(len(haystack))
+	writeReplaced(&buf, s, matches, f)
+
+	return buf.Bytes()
+}
+
+func writeReplaced(str io.StringWriter, haystack string, matches []Match, f func(match Match) (string, bool)) {
 	replaceWith := make([]string, 0)
 
 	for _, match := range matches {
@@ -95,30 +237,21 @@ func (r Replacer) ReplaceAllFunc(haystack string, f func(match Match) (string, b
 		replaceWith = append(replaceWith, rw)
 	}
 
-	str := pool.Get().(*strings.Builder)
-
-	defer func() {
-		str.Reset()
-		pool.Put(str)
-	}()
-
 	start := 0
 
 	for i, match := range matches {
 		if i >= len(replaceWith) {
-			str.WriteString(haystack[start:])
-			return str.String()
+			_, _ = str.WriteString(haystack[start:])
+			return
 		}
-		str.WriteString(haystack[start:match.Start()])
-		str.WriteString(replaceWith[i])
+		_, _ = str.WriteString(haystack[start:match.Start()])
+		_, _ = str.WriteString(replaceWith[i])
 		start = match.End()
 	}
 
 	if start-1 < len(haystack) {
-		str.WriteString(haystack[start:])
+		_, _ = str.WriteString(haystack[start:])
 	}
-
-	return str.String()
 }
 
 // ReplaceAll replaces the matches found in the haystack according to the user provided slice `replaceWith`
@@ -133,6 +266,84 @@ func (r Replacer) ReplaceAll(haystack string, replaceWith []string) string {
 	})
 }
 
+// ReplaceAllBytes is like ReplaceAll but operates on a byte slice haystack
+// It panics, if `replaceWith` has length different from the patterns that it was built with
+func (r Replacer) ReplaceAllBytes(haystack []byte, replaceWith []string) []byte {
+	if len(replaceWith) != r.finder.PatternCount() {
+		panic("replaceWith needs to have the same length as the pattern count")
+	}
+
+	return r.ReplaceAllFuncBytes(haystack, func(match Match) (string, bool) {
+		return replaceWith[match.pattern], true
+	})
+}
+
+// StreamReplaceAllFunc is like ReplaceAllFunc but reads the haystack from r and writes the result to w
+// as it is searched, keeping only a bounded window of the stream in memory. The user provided function
+// is called in the order matches are found and once it returns false, the rest of the stream is copied
+// as is. The Finder must be an AhoCorasick supporting stream searching, see AhoCorasick.StreamFind.
+// Any error while reading or writing stops the replacement and is returned.
+func (r Replacer) StreamReplaceAllFunc(rd io.Reader, w io.Writer, f func(match Match) (string, bool)) error {
+	ac, ok := r.finder.(AhoCorasick)
+	if !ok {
+		return errors.New("aho_corasick: stream replacement requires an AhoCorasick finder")
+	}
+
+	s := ac.streamFind(rd)
+	// Offset in the stream up to which output has been written.
+	written := 0
+	for !s.done() {
+		s.advance()
+		for _, m := range s.matches {
+			rw, ok := f(m)
+			if !ok {
+				if _, err := w.Write(s.buf[written-s.base:]); err != nil {
+					return err
+				}
+				if s.done() {
+					return s.err
+				}
+				_, err := io.Copy(w, rd)
+				return err
+			}
+			if _, err := w.Write(s.buf[written-s.base : m.start-s.base]); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, rw); err != nil {
+				return err
+			}
+			written = m.end
+		}
+		s.matches = s.matches[:0]
+
+		end := s.base + s.discard
+		if s.eof {
+			end = s.base + len(s.buf)
+		}
+		if written < end {
+			if _, err := w.Write(s.buf[written-s.base : end-s.base]); err != nil {
+				return err
+			}
+			written = end
+		}
+	}
+
+	return s.err
+}
+
+// StreamReplaceAll is like ReplaceAll but reads the haystack from r and writes the result to w
+// as it is searched, keeping only a bounded window of the stream in memory. See StreamReplaceAllFunc.
+// It panics, if `replaceWith` has length different from the patterns that it was built with
+func (r Replacer) StreamReplaceAll(rd io.Reader, w io.Writer, replaceWith []string) error {
+	if len(replaceWith) != r.finder.PatternCount() {
+		panic("replaceWith needs to have the same length as the pattern count")
+	}
+
+	return r.StreamReplaceAllFunc(rd, w, func(match Match) (string, bool) {
+		return replaceWith[match.pattern], true
+	})
+}
+
 type Finder interface {
 	FindAll(haystack string) []Match
 	PatternCount() int
@@ -145,169 +356,915 @@ func (ac AhoCorasick) FindAll(haystack string) []Match {
 
 // FindN returns the matches found in the haystack, up to n matches.
 func (ac AhoCorasick) FindN(haystack string, n int) []Match {
-	ac.abi.startOperation(4)
-	defer ac.abi.endOperation()
+	return ac.findN(haystack, 0, len(haystack), n)
+}
+
+// FindAllSpan is like FindAll but only searches the span of the haystack from start to end. Offsets of
+// matches and word boundaries are relative to the entire haystack, only the span is copied for the search.
+func (ac AhoCorasick) FindAllSpan(haystack string, start int, end int) []Match {
+	return ac.findN(haystack, start, end, -1)
+}
+
+// FindNSpan is like FindN but only searches the span of the haystack from start to end. Offsets of
+// matches and word boundaries are relative to the entire haystack, only the span is copied for the search.
+func (ac AhoCorasick) FindNSpan(haystack string, start int, end int, n int) []Match {
+	return ac.findN(haystack, start, end, n)
+}
+
+func (ac AhoCorasick) findN(haystack string, start int, end int, n int) []Match {
+	ac.checkUnanchored()
+
+	ac.state.enter()
+	defer ac.state.exit()
+
+	return ac.search(haystack, start, end, n, ac.wordFilter(haystack))
+}
+
+// wordFilter returns the filter for matches in the haystack that are not whole words, or nil if
+// all matches are reported.
+func (ac AhoCorasick) wordFilter(haystack string) *wordFilter {
+	if !ac.matchOnlyWholeWords {
+		return nil
+	}
+	return ac.wordBoundaries.filter(haystack)
+}
+
+// search finds matches in the span of the haystack, skipping those that are not whole words if words
+// is not nil. The caller must have entered the matcher state.
+func (ac AhoCorasick) search(haystack string, start int, end int, n int, words *wordFilter) []Match {
+	h := ac.mapHaystack(haystack, start, end)
+
+	// With leftmost semantics, matches that are not whole words may hide others, which are searched
+	// for again.
+	hidden := words != nil && ac.matchKind != StandardMatch
+	size := len(h.s) + 12*iterBatchSize
+	if hidden {
+		size += 12 * prefixBatchSize
+	}
+
+	inst := ac.startOperation(size)
+	defer inst.abi.endOperation()
+
+	cs := inst.abi.newCString(h.s)
+
+	f := matchFilter{h: h, words: words}
+	if hidden {
+		f.abi, f.ptr, f.value = inst.abi, inst.ptr, cs
+	}
+	return inst.abi.findN(inst.ptr, cs, n, &f)
+}
+
+// matchFilter collects the matches of a search of the span h, skipping those that are not whole
+// words if words is not nil. With leftmost semantics, ptr is set to the matcher to search value,
+// the searched span, again with for the matches hidden by one that is skipped.
+type matchFilter struct {
+	h     mappedHaystack
+	words *wordFilter
+
+	abi   *ahoCorasickABI
+	ptr   uintptr
+	value cString
+	batch []Match
+}
+
+// add appends m found in the searched span to matches with positions in the haystack, unless it is
+// not a whole word. restart is the position in the searched span the search continues from instead
+// of after m when m hides other matches, otherwise it is -1.
+func (f *matchFilter) add(matches []Match, m Match) ([]Match, int) {
+	start, end := f.h.original(m.start), f.h.originalEnd(m.end)
+	if f.words == nil || !f.words.isNotWholeWord(start, end) {
+		m.start, m.end = start, end
+		return append(matches, m), -1
+	}
+	if f.ptr == 0 {
+		return matches, -1
+	}
+
+	if f.batch == nil {
+		f.batch = make([]Match, prefixBatchSize)
+	}
+	found, ok, restart := hiddenWholeWord(f.abi, f.ptr, f.value, f.h, m, f.words, f.batch)
+	if ok {
+		found.start, found.end = f.h.original(found.start), f.h.originalEnd(found.end)
+		matches = append(matches, found)
+	}
+	return matches, restart
+}
+
+// FindAllContext is like FindAll but stops searching when ctx is done, which is checked before searching
+// for each batch of matches, returning ctx.Err(). This bounds the time spent on haystacks with very many
+// matches, though a haystack without matches is always searched in full.
+func (ac AhoCorasick) FindAllContext(ctx context.Context, haystack string) ([]Match, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	iter := ac.iter(ctx, haystack, 0, len(haystack))
+	defer iter.release()
+
+	var matches []Match
+	for m := iter.Next(); m != nil; m = iter.Next() {
+		matches = append(matches, *m)
+	}
+	if iter.err != nil {
+		return nil, iter.err
+	}
+	return matches, nil
+}
+
+// FindAllBytes is like FindAll but takes the haystack as a byte slice, which is searched without
+// copying it into a string
+func (ac AhoCorasick) FindAllBytes(haystack []byte) []Match {
+	return ac.FindN(bytesToString(haystack), -1)
+}
+
+// FindNBytes is like FindN but takes the haystack as a byte slice, which is searched without
+// copying it into a string
+func (ac AhoCorasick) FindNBytes(haystack []byte, n int) []Match {
+	return ac.FindN(bytesToString(haystack), n)
+}
+
+// IsMatch returns whether there is a match in the haystack. The search stops at the earliest match
+// without collecting any results, so it is faster than checking the result of FindN.
+func (ac AhoCorasick) IsMatch(haystack string) bool {
+	if ac.matchOnlyWholeWords {
+		// The earliest match may not be a whole word, keep iterating until one is.
+		iter := ac.iter(nil, haystack, 0, len(haystack))
+		defer iter.release()
+		return iter.Next() != nil
+	}
 
-	cs := ac.abi.newOwnedCString(haystack)
-	defer ac.abi.freeOwnedCStringPtr(cs.ptr)
+	ac.checkUnanchored()
 
-	return ac.abi.findN(ac.ptr, haystack, cs, n, ac.matchOnlyWholeWords)
+	ac.state.enter()
+	defer ac.state.exit()
+
+	h := ac.mapHaystack(haystack, 0, len(haystack))
+
+	inst := ac.startOperation(len(h.s))
+	defer inst.abi.endOperation()
+
+	cs := inst.abi.newCString(h.s)
+
+	return inst.abi.isMatch(inst.ptr, cs)
+}
+
+// Stats describes the automaton built for a matcher.
+type Stats struct {
+	// Kind is the type of automaton that was built, which is never AutoKind.
+	Kind automatonKind
+	// MemoryUsage is the heap memory in bytes used by the automaton.
+	MemoryUsage int
+	// StateCount is the number of states of the automaton, including its dead, fail and start states.
+	StateCount   int
+	PatternCount int
+	// MinPatternLen and MaxPatternLen are the lengths in bytes of the shortest and longest patterns.
+	MinPatternLen int
+	MaxPatternLen int
+	MatchKind     matchKind
+	// Prefilter is whether a prefilter is used to quickly skip parts of the haystack that cannot match.
+	Prefilter bool
+}
+
+// Stats returns statistics of the automaton, for example to find out the kind of automaton chosen
+// automatically and how much memory it uses. The state count is read by walking the automaton, so
+// Stats takes time proportional to its size and is not meant to be called on every search.
+func (ac AhoCorasick) Stats() Stats {
+	ac.state.enter()
+	defer ac.state.exit()
+
+	inst := ac.startOperation(32)
+	defer inst.abi.endOperation()
+
+	return inst.abi.stats(inst.ptr)
+}
+
+// FindAnchored returns the match starting exactly at offset at of the haystack, or nil if there is none.
+// Offsets of the match are relative to the start of the haystack.
+// It panics if the automaton was not built with StartKind AnchoredStart or BothStart
+func (ac AhoCorasick) FindAnchored(haystack string, at int) *Match {
+	if ac.startKind == UnanchoredStart {
+		panic("anchored searches require StartKind AnchoredStart or BothStart")
+	}
+
+	ac.state.enter()
+	defer ac.state.exit()
+
+	// Matches cannot depend on what precedes the anchor, so only the rest of the haystack is needed.
+	h := ac.mapHaystack(haystack, at, len(haystack))
+
+	inst := ac.startOperation(12 + len(h.s) + 12*iterBatchSize)
+	defer inst.abi.endOperation()
+
+	cs := inst.abi.newCString(h.s)
+
+	pattern, start, end, ok := inst.abi.findAnchored(inst.ptr, cs)
+	if !ok {
+		return nil
+	}
+
+	result := h.match(Match{pattern: pattern, start: start, end: end})
+
+	if words := ac.wordFilter(haystack); words != nil && words.isNotWholeWord(result.Start(), result.End()) {
+		if ac.matchKind == StandardMatch {
+			return nil
+		}
+		if found, ok := preferredWholeWord(inst.abi, inst.ptr, cs, h, 0, words, make([]Match, iterBatchSize)); ok {
+			return h.match(found)
+		}
+		return nil
+	}
+
+	return result
 }
 
 // Opts defines a set of options applied before the patterns are built
 type Opts struct {
 	AsciiCaseInsensitive bool
-	MatchOnlyWholeWords  bool
-	MatchKind            matchKind
-	DFA                  bool
+	// UnicodeCaseInsensitive matches patterns regardless of case with Unicode simple case folding, for
+	// example "ПРИВЕТ" matches "привет", which implies AsciiCaseInsensitive. Haystacks are folded before
+	// searching, copying those with characters to fold, and offsets of matches are in the original
+	// haystack. Folding does not change the number of characters, so "ß" does not match "ss".
+	UnicodeCaseInsensitive bool
+	// Normalization normalizes patterns when building and haystacks before searching to a Unicode
+	// normalization form, so text matches regardless of how it is encoded, for example "café" matches
+	// "cafe\u0301". Haystacks that are not normalized are copied, and offsets of matches are in the
+	// original haystack, covering whole characters along with their combining marks.
+	Normalization normalization
+	// MatchOnlyWholeWords skips matches that are not whole words as defined by WordBoundary. With
+	// leftmost semantics, matches are chosen among whole words only, so a match that is not a whole
+	// word does not hide others overlapping it. This builds a second automaton to find all matches
+	// starting at a position.
+	MatchOnlyWholeWords bool
+	// WordBoundary selects how MatchOnlyWholeWords decides whether a match is a whole word, by
+	// default a match must not be preceded or followed by a letter, digit or combining mark.
+	WordBoundary wordBoundary
+	// IsWordRune overrides WordBoundary with a custom definition of word characters, a match is a
+	// whole word when neither the rune preceding it nor the rune following it is a word character.
+	IsWordRune func(r rune) bool
+	// IsLeftWordRune and IsRightWordRune override the rule for the rune preceding and the rune
+	// following a match respectively, for example to also match prefixes of words with a function
+	// always returning false for IsRightWordRune.
+	IsLeftWordRune  func(r rune) bool
+	IsRightWordRune func(r rune) bool
+	MatchKind       matchKind
+	// DFA forces the use of a DFA, it is the same as setting Kind to DFA and is ignored if Kind is set
+	DFA bool
+	// Kind selects the type of automaton to build, by default it is picked automatically
+	// based on the patterns
+	Kind automatonKind
+	// StartKind selects the kinds of searches supported by the automaton, by default only
+	// unanchored searches are supported
+	StartKind startKind
+	// ShareModule builds the matcher in a WebAssembly module shared with other matchers built with
+	// this option instead of instantiating a module per matcher. This greatly reduces memory usage
+	// when building many small matchers, but searches on matchers sharing a module cannot run in parallel.
+	// It has no effect when using cgo or TinyGo.
+	ShareModule bool
+	// PoolSize is the maximum number of copies of the matcher, each in its own WebAssembly module
+	// instance, used to run searches from multiple goroutines in parallel. Copies are only built when
+	// a search would otherwise wait for another one to finish. Zero uses GOMAXPROCS and one disables
+	// parallel searches. It has no effect with ShareModule or when using cgo or TinyGo.
+	PoolSize int
+	// DenseDepth is the depth from the start state up to which NFA states use dense transitions, which
+	// are faster to search but use more memory. Zero uses the default of the Rust library.
+	DenseDepth int
+	// DisableByteClasses disables grouping bytes that are equivalent for the patterns in transition
+	// tables, which can make searches slightly faster but uses much more memory for a DFA.
+	DisableByteClasses bool
+	// MaxMemory is the maximum memory in bytes used by the automaton, or zero for no limit. A contiguous
+	// NFA is built instead of a DFA, whether automatically chosen or forced, if it could exceed the limit,
+	// and building fails with a *BuildError of kind MaxMemoryError if the automaton still exceeds it.
+	MaxMemory int
 }
 
 // NewAhoCorasickBuilder creates a new AhoCorasickBuilder based on Opts
 func NewAhoCorasickBuilder(o Opts) *AhoCorasickBuilder {
+	kind := o.Kind
+	if kind == AutoKind && o.DFA {
+		kind = DFA
+	}
 	return &AhoCorasickBuilder{
-		asciiCaseInsensitive: o.AsciiCaseInsensitive,
-		matchOnlyWholeWords:  o.MatchOnlyWholeWords,
-		matchKind:            o.MatchKind,
-		dfa:                  o.DFA,
+		asciiCaseInsensitive:   o.AsciiCaseInsensitive,
+		unicodeCaseInsensitive: o.UnicodeCaseInsensitive,
+		normalization:          o.Normalization,
+		matchOnlyWholeWords:    o.MatchOnlyWholeWords,
+		wordBoundaries:         newWordBoundaries(o),
+		matchKind:              o.MatchKind,
+		kind:                   kind,
+		startKind:              o.StartKind,
+		shareModule:            o.ShareModule,
+		poolSize:               o.PoolSize,
+		denseDepth:             o.DenseDepth,
+		disableByteClasses:     o.DisableByteClasses,
+		maxMemory:              o.MaxMemory,
 	}
 }
 
 type AhoCorasickBuilder struct {
-	asciiCaseInsensitive bool
-	matchOnlyWholeWords  bool
-	matchKind            matchKind
-	dfa                  bool
+	asciiCaseInsensitive   bool
+	unicodeCaseInsensitive bool
+	normalization          normalization
+	matchOnlyWholeWords    bool
+	wordBoundaries         wordBoundaries
+	matchKind              matchKind
+	kind                   automatonKind
+	startKind              startKind
+	shareModule            bool
+	poolSize               int
+	denseDepth             int
+	disableByteClasses     bool
+	maxMemory              int
 }
 
 // Build builds a (non)deterministic finite automata from the user provided patterns
+// It panics if the automaton cannot be built, use BuildE to handle the error instead
 func (a *AhoCorasickBuilder) Build(patterns []string) AhoCorasick {
+	ac, err := a.BuildE(patterns)
+	if err != nil {
+		panic(err)
+	}
+	return ac
+}
+
+// BuildE builds a (non)deterministic finite automata from the user provided patterns
+// It returns a *BuildError if the automaton cannot be built, for example when the patterns
+// exceed the limits supported by the automaton, or the error initializing the runtime, see Warmup
+func (a *AhoCorasickBuilder) BuildE(patterns []string) (AhoCorasick, error) {
+	if f, ok := a.normalization.form(); ok {
+		normalized := make([]string, len(patterns))
+		for i, p := range patterns {
+			normalized[i] = f.String(p)
+		}
+		patterns = normalized
+	}
+	if a.unicodeCaseInsensitive {
+		folded := make([]string, len(patterns))
+		for i, p := range patterns {
+			folded[i], _ = foldCase(p)
+		}
+		patterns = folded
+	}
+
 	patternBytes := 0
-	for _, pattern := range patterns {
+	minPatternLen, maxPatternLen := 0, 0
+	for i, pattern := range patterns {
 		patternBytes += len(pattern)
+		if i == 0 || len(pattern) < minPatternLen {
+			minPatternLen = len(pattern)
+		}
+		if len(pattern) > maxPatternLen {
+			maxPatternLen = len(pattern)
+		}
 	}
 
-	abi := newABI()
-	abi.startOperation(patternBytes + 4*len(patterns))
-	ptr := abi.newMatcher(patterns, patternBytes, a.asciiCaseInsensitive, a.dfa, int(a.matchKind))
-	abi.endOperation()
+	var abi *ahoCorasickABI
+	var err error
+	if a.shareModule {
+		abi, err = sharedABI()
+	} else {
+		abi, err = newABI()
+	}
+	if err != nil {
+		return AhoCorasick{}, err
+	}
+	ptr, err := a.newMatcher(abi, patterns, patternBytes)
+	if err != nil {
+		return AhoCorasick{}, err
+	}
 
+	var pool *matcherPool
+	if size := a.matcherPoolSize(); size > 1 {
+		pool = &matcherPool{
+			source: &matcherSource{
+				builder:      *a,
+				patterns:     append([]string(nil), patterns...),
+				patternBytes: patternBytes,
+			},
+			instances: []matcherInstance{{abi: abi, ptr: ptr}},
+			size:      size,
+		}
+	}
+
+	state := &matcherState{}
 	// Use func(interface{}) form for nottinygc compatibility
-	runtime.SetFinalizer(abi, func(obj interface{}) {
-		obj.(*ahoCorasickABI).deleteMatcher(ptr)
+	runtime.SetFinalizer(state, func(obj interface{}) {
+		_ = obj.(*matcherState).close(abi, ptr, pool)
 	})
 
 	return AhoCorasick{
-		ptr:                 ptr,
-		abi:                 abi,
-		matchOnlyWholeWords: a.matchOnlyWholeWords,
-		patternCount:        len(patterns),
+		ptr:                    ptr,
+		abi:                    abi,
+		state:                  state,
+		pool:                   pool,
+		matchOnlyWholeWords:    a.matchOnlyWholeWords,
+		wordBoundaries:         a.wordBoundaries,
+		unicodeCaseInsensitive: a.unicodeCaseInsensitive,
+		normalization:          a.normalization,
+		matchKind:              a.matchKind,
+		startKind:              a.startKind,
+		patternCount:           len(patterns),
+		minPatternLen:          minPatternLen,
+		maxPatternLen:          maxPatternLen,
+	}, nil
+}
+
+// newMatcher builds the automaton for the patterns in the module instance of abi.
+func (a *AhoCorasickBuilder) newMatcher(abi *ahoCorasickABI, patterns []string, patternBytes int) (uintptr, error) {
+	abi.startOperation(patternBytes + 4*len(patterns) + 12)
+	defer abi.endOperation()
+
+	// Leftmost semantics only report one of the matches starting at a position, the others are
+	// needed in case it is not a whole word.
+	prefixes := a.matchOnlyWholeWords && a.matchKind != StandardMatch
+	return abi.newMatcher(patterns, patternBytes, a.asciiCaseInsensitive, int(a.kind), int(a.matchKind), int(a.startKind), a.denseDepth, !a.disableByteClasses, a.maxMemory, prefixes)
+}
+
+// matcherPoolSize returns the maximum number of copies of a matcher to build for parallel searches.
+func (a *AhoCorasickBuilder) matcherPoolSize() int {
+	if !matcherPoolSupported || a.shareModule {
+		return 1
+	}
+	if a.poolSize <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return a.poolSize
+}
+
+// BuildBytes builds a (non)deterministic finite automata from the user provided binary patterns
+// Patterns are not required to be valid UTF-8
+// It panics if the automaton cannot be built, use BuildBytesE to handle the error instead
+func (a *AhoCorasickBuilder) BuildBytes(patterns [][]byte) AhoCorasick {
+	ac, err := a.BuildBytesE(patterns)
+	if err != nil {
+		panic(err)
+	}
+	return ac
+}
+
+// BuildBytesE builds a (non)deterministic finite automata from the user provided binary patterns
+// Patterns are not required to be valid UTF-8
+// It returns a *BuildError if the automaton cannot be built
+func (a *AhoCorasickBuilder) BuildBytesE(patterns [][]byte) (AhoCorasick, error) {
+	// Patterns are copied into the matcher during the build so it is fine to share their memory,
+	// unless they are kept to build more copies of the matcher later.
+	keep := a.matcherPoolSize() > 1
+	strs := make([]string, len(patterns))
+	for i, p := range patterns {
+		if keep {
+			strs[i] = string(p)
+		} else {
+			strs[i] = bytesToString(p)
+		}
+	}
+	return a.BuildE(strs)
+}
+
+// matcherSource is what a matcher was built from, kept to build copies of it.
+type matcherSource struct {
+	builder      AhoCorasickBuilder
+	patterns     []string
+	patternBytes int
+}
+
+// BuildError is returned by BuildE when the automaton cannot be built from the provided patterns
+type BuildError struct {
+	// Kind is the reason the automaton could not be built.
+	Kind buildErrorKind
+	msg  string
+}
+
+type buildErrorKind int
+
+const (
+	// The Rust library could not build the automaton, for example because it has more states than
+	// can be identified.
+	AutomatonError buildErrorKind = iota
+	// The automaton uses more memory than MaxMemory allows.
+	MaxMemoryError
+	// The WebAssembly module trapped while building the automaton, for example when running out of
+	// memory. This does not happen when using cgo or TinyGo, which abort instead.
+	TrapError
+)
+
+func (e *BuildError) Error() string {
+	return "aho_corasick: failed to build automaton: " + e.msg
+}
+
+// Warmup initializes the WebAssembly runtime, which otherwise happens when building the first matcher.
+// Programs can call it on startup to pay the cost of compiling the module up front and handle any
+// error initializing it. It returns ctx.Err() if ctx is done first, the initialization still completes
+// in the background. It does nothing when using cgo or TinyGo.
+func Warmup(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- initRuntime()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ErrClosed is returned by FindAllContext and the Err method of iterators when using a matcher after
+// it has been closed, and methods without an error result panic with it.
+var ErrClosed = errors.New("aho_corasick: use of closed matcher")
+
+// matcherState is shared by all copies of an AhoCorasick and its iterators to coordinate closing
+// the matcher with operations that are using it.
+type matcherState struct {
+	mu     sync.RWMutex
+	closed bool
+}
+
+// tryEnter marks the start of an operation using the matcher, returning false if it is closed.
+func (s *matcherState) tryEnter() bool {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+// enter is like tryEnter but panics with ErrClosed if the matcher is closed, for methods without an
+// error result to report it with.
+func (s *matcherState) enter() {
+	if !s.tryEnter() {
+		panic(ErrClosed)
 	}
 }
 
+// exit marks the end of an operation started with a successful tryEnter.
+func (s *matcherState) exit() {
+	s.mu.RUnlock()
+}
+
+func (s *matcherState) close(abi *ahoCorasickABI, ptr uintptr, pool *matcherPool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if pool != nil {
+		return pool.close()
+	}
+	return abi.close(ptr)
+}
+
+// iterBatchSize is the largest number of matches read at once by iterators, to avoid a call into the
+// automaton for every match.
+const iterBatchSize = 64
+
+// firstBatchSize is the number of matches read by the first call of a search or iterator, which
+// reads more at once only when there are more, so searches with few matches allocate little.
+const firstBatchSize = 8
+
+// iterBatch returns the batch an iterator reads its next matches to once the pending ones are
+// returned. It is allocated on first use with firstBatchSize matches and doubled up to
+// iterBatchSize when the last read filled it, which leaves no capacity after the pending matches.
+func iterBatch(batch []Match, pending []Match) []Match {
+	if batch == nil {
+		return make([]Match, firstBatchSize)
+	}
+	if cap(pending) == 0 && len(batch) < iterBatchSize {
+		return make([]Match, 2*len(batch))
+	}
+	return batch
+}
+
+// prefixBatchSize is the number of matches starting at the same position read at once when
+// searching again for those hidden by a match that is not a whole word.
+const prefixBatchSize = 8
+
 // Iter is an iterator over matches found on the current haystack
 // it gives the user more granular control. You can chose how many and what kind of matches you need.
 type Iter interface {
 	Next() *Match
+	// Close releases the iterator before it is exhausted. It is safe to call Close multiple times
+	// and Next returns nil after closing.
+	Close() error
+}
+
+// ContextIter is an iterator over matches that stops when its context is done.
+type ContextIter interface {
+	Iter
+	// Err returns the error that stopped the iteration before all matches were found, or nil.
+	Err() error
 }
 
 type findIter struct {
-	ptr                 uintptr
-	abi                 *ahoCorasickABI
-	matchOnlyWholeWords bool
-	haystack            string
-	haystackPtr         uintptr
+	ptr   uintptr
+	abi   *ahoCorasickABI
+	state *matcherState
+	words *wordFilter
+	// haystack is the searched span of the haystack, which haystackPtr points to or is a copy of.
+	haystack    mappedHaystack
+	haystackPtr uintptr
+	// offset is the position in the searched span the current search started from.
+	offset int
+	// matcher is set with leftmost semantics when matches must be whole words, to search again from
+	// another position of the searched span, reading the matches at a position to prefixBatch.
+	// exhausted is whether there are no more matches than the pending ones.
+	matcher     uintptr
+	prefixBatch []Match
+	exhausted   bool
+	// batch holds matches read from the iterator at once, of which pending are not yet returned.
+	batch   []Match
+	pending []Match
+	// ctx is checked before reading each batch when not nil, err is the reason iteration stopped early.
+	ctx context.Context
+	err error
 }
 
 // Next gives a pointer to the next match yielded by the iterator or nil, if there is none
 func (f *findIter) Next() *Match {
-	if f.ptr == 0 {
+	for {
+		if f.ptr == 0 {
+			return nil
+		}
+
+		if len(f.pending) == 0 && f.ctx != nil {
+			if err := f.ctx.Err(); err != nil {
+				f.err = err
+				f.release()
+				return nil
+			}
+		}
+
+		if len(f.pending) == 0 && f.exhausted {
+			f.release()
+			return nil
+		}
+
+		if !f.state.tryEnter() {
+			f.closed()
+			return nil
+		}
+		if len(f.pending) == 0 {
+			f.batch = iterBatch(f.batch, f.pending)
+			f.abi.startOperation(12 * len(f.batch))
+			n := f.abi.findIterNextBatch(f.ptr, f.batch)
+			f.abi.endOperation()
+			f.pending = f.batch[:n]
+		}
+		f.state.exit()
+
+		if len(f.pending) == 0 {
+			f.release()
+			return nil
+		}
+
+		m := f.pending[0]
+		f.pending = f.pending[1:]
+		m.start += f.offset
+		m.end += f.offset
+		result := f.haystack.match(m)
+
+		if f.words != nil && f.words.isNotWholeWord(result.Start(), result.End()) {
+			if f.matcher != 0 {
+				if found := f.searchAgain(m); found != nil {
+					return found
+				}
+			}
+			continue
+		}
+
+		return result
+	}
+}
+
+// searchAgain returns the match to report instead of one that is not a whole word, which with
+// leftmost semantics is the most preferred whole word starting at the same position. Pending
+// matches may overlap whole words that are not hidden anymore, so the search is restarted when
+// the rejected match hides any. Positions of the rejected match are in the searched span.
+func (f *findIter) searchAgain(rejected Match) *Match {
+	if !f.state.tryEnter() {
+		f.closed()
 		return nil
 	}
+	defer f.state.exit()
 
-	f.abi.startOperation(12)
-	pattern, start, end, ok := f.abi.findIterNext(f.ptr)
-	f.abi.endOperation()
+	if f.prefixBatch == nil {
+		f.prefixBatch = make([]Match, prefixBatchSize)
+	}
+	f.abi.startOperation(12 * prefixBatchSize)
+	defer f.abi.endOperation()
+
+	found, ok, restart := hiddenWholeWord(f.abi, f.matcher, f.haystackAt(0), f.haystack, rejected, f.words, f.prefixBatch)
+	if restart < 0 {
+		return nil
+	}
+	if restart > len(f.haystack.s) {
+		restart = len(f.haystack.s)
+		f.exhausted = true
+	}
+
+	f.abi.findIterDelete(f.ptr)
+	f.ptr = f.abi.findIter(f.matcher, f.haystackAt(restart))
+	f.offset = restart
+	f.pending = nil
 
 	if !ok {
-		f.release()
 		return nil
 	}
+	return f.haystack.match(found)
+}
 
-	result := &Match{
-		pattern: pattern,
-		start:   start,
-		end:     end,
+// closed stops the iteration after the matcher was closed. Iterators without a context cannot report
+// it with Err, so they panic with ErrClosed instead.
+func (f *findIter) closed() {
+	f.ptr = 0
+	f.err = ErrClosed
+	if f.ctx == nil {
+		panic(ErrClosed)
 	}
+}
+
+// haystackAt returns the rest of the searched span from position at.
+func (f *findIter) haystackAt(at int) cString {
+	return cString{ptr: f.haystackPtr + uintptr(at), length: len(f.haystack.s) - at}
+}
 
-	if f.matchOnlyWholeWords {
-		if isNotWholeWord(f.haystack, result.Start(), result.End()) {
-			return f.Next()
+// hiddenWholeWord returns the match to report instead of rejected, which is not a whole word and with
+// leftmost semantics may hide other matches starting at its position or inside of it. These are
+// searched for again from restart, which is after the returned match, the most preferred whole word
+// starting at the same position, or after the start of rejected if there is none. restart is -1 if
+// no whole word can be hidden, so the search continues after rejected. value is the searched span h,
+// which positions are in. The operation must reserve 12 bytes per match of batch.
+func hiddenWholeWord(abi *ahoCorasickABI, ptr uintptr, value cString, h mappedHaystack, rejected Match, words *wordFilter, batch []Match) (Match, bool, int) {
+	if words.canStart(h.original(rejected.start)) {
+		at := rejected.start
+		rest := cString{ptr: value.ptr + uintptr(at), length: value.length - at}
+		if found, ok := preferredWholeWord(abi, ptr, rest, h, at, words, batch); ok {
+			restart := found.end
+			if found.start == found.end {
+				// The other matches at the position were already considered.
+				restart++
+			}
+			return found, true, restart
 		}
 	}
 
-	return result
+	for i := rejected.start + 1; i < rejected.end; i++ {
+		if words.canStart(h.original(i)) {
+			return Match{}, false, rejected.start + 1
+		}
+	}
+	return Match{}, false, -1
+}
+
+// preferredWholeWord returns the most preferred of the matches starting at the beginning of value
+// that is a whole word, if there is one. value is at position at of the searched span h, which is
+// also where the positions of the returned match are. The operation must reserve 12 bytes per match
+// of the batch.
+func preferredWholeWord(abi *ahoCorasickABI, ptr uintptr, value cString, h mappedHaystack, at int, words *wordFilter, batch []Match) (Match, bool) {
+	skip := 0
+	for {
+		n := abi.prefixMatches(ptr, value, skip, batch)
+		for _, m := range batch[:n] {
+			m.start += at
+			m.end += at
+			if !words.isNotWholeWord(h.original(m.start), h.originalEnd(m.end)) {
+				return m, true
+			}
+		}
+		if n < len(batch) {
+			return Match{}, false
+		}
+		skip += n
+	}
+}
+
+// Err returns ctx.Err() if the context of the iterator ended the iteration, or ErrClosed if the
+// matcher was closed.
+func (f *findIter) Err() error {
+	return f.err
+}
+
+func (f *findIter) Close() error {
+	f.release()
+	return nil
 }
 
 func (f *findIter) release() {
+	if f.ptr == 0 {
+		return
+	}
+
+	// The iterator does not use the matcher once created, so it is deleted even if the matcher was
+	// closed, unless it was released along with the module. Operations without memory to reserve do
+	// not call into the module before checking.
 	f.abi.startOperation(0)
-	if f.ptr != 0 {
+	if !f.abi.moduleClosed() {
 		f.abi.findIterDelete(f.ptr)
 		f.abi.freeOwnedCStringPtr(f.haystackPtr)
-		f.ptr = 0
 	}
+	f.ptr = 0
 	f.abi.endOperation()
 }
 
 // While currently it could be possible to reuse findIter, the implementation
 // seems like it will change significantly in next aho-corasick release
 type overlappingIter struct {
-	ptr                 uintptr
-	abi                 *ahoCorasickABI
-	matchOnlyWholeWords bool
-	haystack            string
-	haystackPtr         uintptr
+	ptr   uintptr
+	abi   *ahoCorasickABI
+	state *matcherState
+	words *wordFilter
+	// haystack is the searched span of the haystack, which haystackPtr points to or is a copy of.
+	haystack    mappedHaystack
+	haystackPtr uintptr
+	// batch holds matches read from the iterator at once, of which pending are not yet returned.
+	batch   []Match
+	pending []Match
+	// ctx is checked before reading each batch when not nil, err is the reason iteration stopped early.
+	ctx context.Context
+	err error
 }
 
 // Next gives a pointer to the next match yielded by the iterator or nil, if there is none
 func (o *overlappingIter) Next() *Match {
-	if o.ptr == 0 {
-		return nil
-	}
-
-	o.abi.startOperation(12)
-	pattern, start, end, ok := o.abi.overlappingIterNext(o.ptr)
-	o.abi.endOperation()
+	for {
+		if o.ptr == 0 {
+			return nil
+		}
 
-	if !ok {
-		o.release()
-		return nil
-	}
+		if len(o.pending) == 0 && o.ctx != nil {
+			if err := o.ctx.Err(); err != nil {
+				o.err = err
+				o.release()
+				return nil
+			}
+		}
 
-	result := &Match{
-		pattern: pattern,
-		start:   start,
-		end:     end,
-	}
+		if !o.state.tryEnter() {
+			o.closed()
+			return nil
+		}
+		if len(o.pending) == 0 {
+			o.batch = iterBatch(o.batch, o.pending)
+			o.abi.startOperation(12 * len(o.batch))
+			n := o.abi.overlappingIterNextBatch(o.ptr, o.batch)
+			o.abi.endOperation()
+			o.pending = o.batch[:n]
+		}
+		o.state.exit()
 
-	if o.matchOnlyWholeWords {
-		if result.Start()-1 >= 0 && (unicode.IsLetter(rune(o.haystack[result.Start()-1])) || unicode.IsDigit(rune(o.haystack[result.Start()-1]))) {
-			return o.Next()
+		if len(o.pending) == 0 {
+			o.release()
+			return nil
 		}
-		if result.end < len(o.haystack) && (unicode.IsLetter(rune(o.haystack[result.end])) || unicode.IsDigit(rune(o.haystack[result.end]))) {
-			return o.Next()
+
+		result := o.haystack.match(o.pending[0])
+		o.pending = o.pending[1:]
+
+		if o.words != nil && o.words.isNotWholeWord(result.Start(), result.End()) {
+			continue
 		}
+
+		return result
+	}
+}
+
+// closed is like the closed method of findIter.
+func (o *overlappingIter) closed() {
+	o.ptr = 0
+	o.err = ErrClosed
+	if o.ctx == nil {
+		panic(ErrClosed)
 	}
+}
 
-	return result
+// Err returns ctx.Err() if the context of the iterator ended the iteration, or ErrClosed if the
+// matcher was closed.
+func (o *overlappingIter) Err() error {
+	return o.err
+}
+
+func (o *overlappingIter) Close() error {
+	o.release()
+	return nil
 }
 
 func (o *overlappingIter) release() {
+	if o.ptr == 0 {
+		return
+	}
+
+	// The iterator does not use the matcher once created, so it is deleted even if the matcher was
+	// closed, unless it was released along with the module. Operations without memory to reserve do
+	// not call into the module before checking.
 	o.abi.startOperation(0)
-	if o.ptr != 0 {
+	if !o.abi.moduleClosed() {
 		o.abi.overlappingIterDelete(o.ptr)
 		o.abi.freeOwnedCStringPtr(o.haystackPtr)
-		o.ptr = 0
 	}
+	o.ptr = 0
 	o.abi.endOperation()
 }
 
@@ -328,6 +1285,36 @@ const (
 	LeftMostLongestMatch
 )
 
+type automatonKind int
+
+const (
+	// Automatically pick the automaton based on the patterns. Generally, a noncontiguous NFA
+	// is used for very large numbers of patterns, a DFA for small numbers of patterns and a
+	// contiguous NFA otherwise. The heuristics may change between versions of the Rust library.
+	AutoKind automatonKind = iota
+	// Use a noncontiguous NFA, which is the fastest to build and uses more memory than a
+	// contiguous NFA, but is generally the slowest to search.
+	NoncontiguousNFA
+	// Use a contiguous NFA, which is slower to build than a noncontiguous NFA but faster to
+	// search and uses less memory.
+	ContiguousNFA
+	// Use a DFA, which is the slowest to build and uses the most memory, but is the fastest
+	// to search.
+	DFA
+)
+
+type startKind int
+
+const (
+	// Support only unanchored searches, which report matches starting anywhere in the haystack.
+	UnanchoredStart startKind = iota
+	// Support only anchored searches with FindAnchored. Other search methods panic.
+	AnchoredStart
+	// Support both unanchored and anchored searches. This may use up to twice as much memory
+	// and make searches slower for some automatons.
+	BothStart
+)
+
 // A representation of a match reported by an Aho-Corasick automaton.
 //
 // A match has two essential pieces of information: the identifier of the
@@ -355,13 +1342,11 @@ func (m *Match) Start() int {
 	return m.start
 }
 
-func isNotWholeWord(s string, start int, end int) bool {
-	if start-1 >= 0 && (unicode.IsLetter(rune(s[start-1])) || unicode.IsDigit(rune(s[start-1]))) {
-		return true
+// bytesToString returns a string sharing memory with b. It is only used to pass byte haystacks through
+// the string based internals, which never retain the string beyond the lifetime of the search.
+func bytesToString(b []byte) string {
+	if len(b) == 0 {
+		return ""
 	}
-	if end < len(s) && (unicode.IsLetter(rune(s[end])) || unicode.IsDigit(rune(s[end]))) {
-		return true
-	}
-
-	return false
+	return unsafe.String(&b[0], len(b))
 }
@@ -1,8 +1,17 @@
 package aho_corasick
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
+	"unicode"
 )
 
 func TestAhoCorasick_ReplaceAllFuncStopN(t *testing.T) {
@@ -102,21 +111,6 @@ func TestAhoCorasick_ReplaceAllFunc(t *testing.T) {
 	}
 }
 
-var acsNFA []Replacer
-
-func init() {
-	acsNFA = make([]Replacer, len(testCasesReplace))
-	for i, t2 := range testCasesReplace {
-		builder := NewAhoCorasickBuilder(Opts{
-			AsciiCaseInsensitive: true,
-			MatchOnlyWholeWords:  true,
-			MatchKind:            LeftMostLongestMatch,
-		})
-		ac := builder.Build(t2.patterns)
-		acsNFA[i] = NewReplacer(ac)
-	}
-}
-
 var testCasesReplace = []testCaseReplace{
 	{
 		name:        "medium",
@@ -156,6 +150,272 @@ type testCaseReplace struct {
 	replaced    string
 }
 
+func TestAhoCorasick_BuildE(t *testing.T) {
+	t2 := leftmostInsensitiveWholeWordTestCases[0]
+	builder := NewAhoCorasickBuilder(Opts{
+		AsciiCaseInsensitive: true,
+		MatchOnlyWholeWords:  true,
+		MatchKind:            LeftMostLongestMatch,
+	})
+
+	ac, err := builder.BuildE(t2.patterns)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	matches := ac.FindAll(t2.haystack)
+	if len(matches) != len(t2.matches) {
+		t.Errorf("expected %v matches got %v", len(t2.matches), len(matches))
+	}
+
+	// A DFA with a transition for every byte of every state of the patterns has too many transitions
+	// to be addressed with 32-bit state identifiers, and the anchored start duplicates all states.
+	r := rand.New(rand.NewSource(1))
+	patterns := make([]string, 45000)
+	pattern := make([]byte, 100)
+	for i := range patterns {
+		r.Read(pattern)
+		patterns[i] = string(pattern)
+	}
+	_, err = NewAhoCorasickBuilder(Opts{
+		Kind:               DFA,
+		StartKind:          BothStart,
+		DisableByteClasses: true,
+	}).BuildE(patterns)
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("expected *BuildError got %v", err)
+	}
+	if buildErr.Kind != AutomatonError {
+		t.Errorf("expected AutomatonError got %v: %v", buildErr.Kind, err)
+	}
+}
+
+func TestAhoCorasick_MaxMemory(t *testing.T) {
+	patterns := make([]string, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		patterns = append(patterns, fmt.Sprintf("word%dx%d", i*7919, i))
+	}
+	haystack := "a " + patterns[10] + " b " + patterns[1999]
+
+	// A DFA for the patterns would exceed the limit, so a contiguous NFA is built instead.
+	builder := NewAhoCorasickBuilder(Opts{
+		Kind:      DFA,
+		MaxMemory: 1024 * 1024,
+	})
+	ac, err := builder.BuildE(patterns)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if matches := ac.FindAll(haystack); len(matches) != 2 || matches[0].Pattern() != 10 || matches[1].Pattern() != 1999 {
+		t.Errorf("unexpected matches %v", matches)
+	}
+	if stats := ac.Stats(); stats.Kind != ContiguousNFA || stats.MemoryUsage > 1024*1024 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	builder = NewAhoCorasickBuilder(Opts{
+		MaxMemory:  1024,
+		DenseDepth: 1,
+	})
+	_, err = builder.BuildE(patterns)
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("expected BuildError got %v", err)
+	}
+	if buildErr.Kind != MaxMemoryError {
+		t.Errorf("expected MaxMemoryError got %v: %v", buildErr.Kind, err)
+	}
+}
+
+func TestAhoCorasick_Stats(t *testing.T) {
+	builder := NewAhoCorasickBuilder(Opts{
+		MatchKind: LeftMostFirstMatch,
+		Kind:      DFA,
+	})
+	ac := builder.Build([]string{"abc", "abd", "x"})
+	stats := ac.Stats()
+	if stats.Kind != DFA {
+		t.Errorf("expected DFA got %v", stats.Kind)
+	}
+	if stats.MemoryUsage <= 0 {
+		t.Errorf("expected memory usage got %d", stats.MemoryUsage)
+	}
+	// a, ab, abc, abd and x along with the dead, fail and two start states.
+	if stats.StateCount != 9 {
+		t.Errorf("expected 9 states got %d", stats.StateCount)
+	}
+	if stats.PatternCount != 3 || stats.MinPatternLen != 1 || stats.MaxPatternLen != 3 {
+		t.Errorf("unexpected pattern stats %+v", stats)
+	}
+	if stats.MatchKind != LeftMostFirstMatch {
+		t.Errorf("expected LeftMostFirstMatch got %v", stats.MatchKind)
+	}
+
+	// The pattern after the match state of "ab" is never added.
+	ac = NewAhoCorasickBuilder(Opts{
+		AsciiCaseInsensitive: true,
+		MatchKind:            LeftMostFirstMatch,
+	}).Build([]string{"ab", "AbC"})
+	if stats := ac.Stats(); stats.StateCount != 6 || stats.Kind == AutoKind {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Matching whole words with leftmost semantics also builds the automaton of matches at a position.
+	words := NewAhoCorasickBuilder(Opts{
+		MatchKind:           LeftMostFirstMatch,
+		Kind:                DFA,
+		MatchOnlyWholeWords: true,
+	}).Build([]string{"abc", "abd", "x"})
+	if got := words.Stats().MemoryUsage; got <= stats.MemoryUsage {
+		t.Errorf("expected memory usage above %d got %d", stats.MemoryUsage, got)
+	}
+}
+
+func TestAhoCorasick_Bytes(t *testing.T) {
+	for i, t2 := range testCasesReplace {
+		builder := NewAhoCorasickBuilder(Opts{
+			AsciiCaseInsensitive: true,
+			MatchOnlyWholeWords:  true,
+			MatchKind:            LeftMostLongestMatch,
+		})
+
+		ac := builder.Build(t2.patterns)
+		haystack := []byte(t2.haystack)
+
+		expected := ac.FindAll(t2.haystack)
+		matches := ac.FindAllBytes(haystack)
+		if !reflect.DeepEqual(matches, expected) {
+			t.Errorf("test %v expected %v matches got %v", i, expected, matches)
+		}
+
+		if matches := ac.FindNBytes(haystack, 1); !reflect.DeepEqual(matches, expected[:1]) {
+			t.Errorf("test %v expected %v matches got %v", i, expected[:1], matches)
+		}
+
+		iter := ac.IterBytes(haystack)
+		matches = make([]Match, 0)
+		for next := iter.Next(); next != nil; next = iter.Next() {
+			matches = append(matches, *next)
+		}
+		if !reflect.DeepEqual(matches, expected) {
+			t.Errorf("test %v expected %v matches got %v", i, expected, matches)
+		}
+
+		replaced := NewReplacer(ac).ReplaceAllBytes(haystack, t2.replaceWith)
+		if string(replaced) != t2.replaced {
+			t.Errorf("test %v expected %v got %v", i, t2.replaced, string(replaced))
+		}
+	}
+}
+
+func TestAhoCorasick_BuildBytes(t *testing.T) {
+	builder := NewAhoCorasickBuilder(Opts{
+		MatchKind: LeftMostLongestMatch,
+	})
+
+	ac := builder.BuildBytes([][]byte{{0xff, 0xfe}, {0x00, 0xc3}, {0x89, 0x50, 0x4e, 0x47}})
+	haystack := []byte{0x00, 0xc3, 0x28, 0xff, 0xfe, 0x00, 0x89, 0x50, 0x4e, 0x47, 0x0d}
+
+	expected := []Match{
+		{pattern: 1, start: 0, end: 2},
+		{pattern: 0, start: 3, end: 5},
+		{pattern: 2, start: 6, end: 10},
+	}
+	if matches := ac.FindAllBytes(haystack); !reflect.DeepEqual(matches, expected) {
+		t.Errorf("expected %v matches got %v", expected, matches)
+	}
+}
+
+func TestAhoCorasick_StreamFind(t *testing.T) {
+	for i, t2 := range leftmostInsensitiveWholeWordTestCases {
+		builder := NewAhoCorasickBuilder(Opts{
+			AsciiCaseInsensitive: true,
+			MatchOnlyWholeWords:  true,
+			MatchKind:            StandardMatch,
+		})
+
+		ac := builder.Build(t2.patterns)
+		expected := ac.FindAll(t2.haystack)
+
+		readers := []io.Reader{strings.NewReader(t2.haystack), iotest.HalfReader(strings.NewReader(t2.haystack))}
+		if len(t2.haystack) < 100 {
+			readers = append(readers, iotest.OneByteReader(strings.NewReader(t2.haystack)))
+		}
+		for _, r := range readers {
+			iter := ac.StreamFind(r)
+			matches := make([]Match, 0)
+			for next := iter.Next(); next != nil; next = iter.Next() {
+				matches = append(matches, *next)
+			}
+			if err := iter.Err(); err != nil {
+				t.Fatalf("test %v unexpected error %v", i, err)
+			}
+			if !reflect.DeepEqual(matches, expected) {
+				t.Errorf("test %v expected %v matches got %v", i, expected, matches)
+			}
+		}
+	}
+
+	ac := NewAhoCorasickBuilder(Opts{MatchKind: LeftMostLongestMatch}).Build([]string{"bear"})
+	iter := ac.StreamFind(strings.NewReader("bear"))
+	if next := iter.Next(); next != nil {
+		t.Errorf("expected no matches got %v", next)
+	}
+	if err := iter.Err(); !errors.Is(err, ErrStreamUnsupportedMatchKind) {
+		t.Errorf("expected ErrStreamUnsupportedMatchKind got %v", err)
+	}
+}
+
+func TestAhoCorasick_StreamReplaceAll(t *testing.T) {
+	for _, i2 := range testCasesReplace {
+		builder := NewAhoCorasickBuilder(Opts{
+			AsciiCaseInsensitive: true,
+			MatchOnlyWholeWords:  true,
+			MatchKind:            StandardMatch,
+		})
+
+		r := NewReplacer(builder.Build(i2.patterns))
+		expected := r.ReplaceAll(i2.haystack, i2.replaceWith)
+
+		for _, rd := range []io.Reader{strings.NewReader(i2.haystack), iotest.HalfReader(strings.NewReader(i2.haystack))} {
+			var out strings.Builder
+			if err := r.StreamReplaceAll(rd, &out, i2.replaceWith); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if out.String() != expected {
+				t.Errorf("expected %v got %v", expected, out.String())
+			}
+		}
+	}
+
+	for _, i2 := range testCasesReplaceN {
+		builder := NewAhoCorasickBuilder(Opts{
+			AsciiCaseInsensitive: true,
+			MatchOnlyWholeWords:  true,
+			MatchKind:            StandardMatch,
+		})
+
+		r := NewReplacer(builder.Build(i2.patterns))
+		stop := func() func(match Match) (string, bool) {
+			i := -1
+			return func(match Match) (string, bool) {
+				i += 1
+				return i2.replaceWith[match.pattern], i2.stopAt != i
+			}
+		}
+		expected := r.ReplaceAllFunc(i2.haystack, stop())
+
+		var out strings.Builder
+		if err := r.StreamReplaceAllFunc(iotest.HalfReader(strings.NewReader(i2.haystack)), &out, stop()); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if out.String() != expected {
+			t.Errorf("expected %v got %v", expected, out.String())
+		}
+	}
+}
+
 func TestAhoCorasick_Iter(t *testing.T) {
 	for i, t2 := range leftmostInsensitiveWholeWordTestCases {
 		builder := NewAhoCorasickBuilder(Opts{
@@ -212,6 +472,188 @@ func TestAhoCorasick_Parallel(t *testing.T) {
 	w.Wait()
 }
 
+func TestAhoCorasick_PoolSize(t *testing.T) {
+	t2 := leftmostInsensitiveWholeWordTestCases[0]
+	builder := NewAhoCorasickBuilder(Opts{
+		AsciiCaseInsensitive: true,
+		MatchOnlyWholeWords:  true,
+		MatchKind:            LeftMostLongestMatch,
+		PoolSize:             4,
+	})
+
+	ac := builder.Build(t2.patterns)
+	var w sync.WaitGroup
+
+	w.Add(50)
+	for i := 0; i < 50; i++ {
+		go func(i int) {
+			defer w.Done()
+			var matches []Match
+			if i%2 == 0 {
+				matches = ac.FindAll(t2.haystack)
+			} else {
+				iter := ac.Iter(t2.haystack)
+				for m := iter.Next(); m != nil; m = iter.Next() {
+					matches = append(matches, *m)
+				}
+			}
+			if !reflect.DeepEqual(matches, t2.matches) {
+				t.Errorf("test %v expected %v matches got %v", i, t2.matches, matches)
+			}
+			if !ac.IsMatch(t2.haystack) {
+				t.Errorf("test %v expected a match", i)
+			}
+		}(i)
+	}
+	w.Wait()
+
+	if matcherPoolSupported {
+		if n := len(ac.pool.instances); n > 4 {
+			t.Errorf("expected at most 4 copies of the matcher got %v", n)
+		}
+
+		// Operations holding every copy do not wait on each other, and a copy is built for each until
+		// the pool is full.
+		insts := make([]matcherInstance, 0, 4)
+		for i := 0; i < 4; i++ {
+			inst := ac.startOperation(0)
+			for _, other := range insts {
+				if inst.abi == other.abi {
+					t.Errorf("operation %v uses a busy copy of the matcher", i)
+				}
+			}
+			insts = append(insts, inst)
+		}
+		if n := len(ac.pool.instances); n != 4 {
+			t.Errorf("expected 4 copies of the matcher got %v", n)
+		}
+		if _, ok := ac.pool.grow(); ok {
+			t.Error("expected the pool to stop growing at PoolSize")
+		}
+		for _, inst := range insts {
+			inst.abi.endOperation()
+		}
+	}
+
+	if err := ac.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestAhoCorasick_HaystackSizes(t *testing.T) {
+	builder := NewAhoCorasickBuilder(Opts{})
+	ac := builder.Build([]string{"abc"})
+
+	large := strings.Repeat("xabc", 100000)
+	if matches := ac.FindAll(large); len(matches) != 100000 {
+		t.Fatalf("expected %v matches got %v", 100000, len(matches))
+	}
+
+	for i := 0; i < 200; i++ {
+		haystack := strings.Repeat("xabc", i%5)
+		if matches := ac.FindAll(haystack); len(matches) != i%5 {
+			t.Fatalf("test %v expected %v matches got %v", i, i%5, len(matches))
+		}
+		if ac.IsMatch(haystack) != (i%5 > 0) {
+			t.Fatalf("test %v expected match %v", i, i%5 > 0)
+		}
+	}
+}
+
+func TestAhoCorasick_IterManyMatches(t *testing.T) {
+	builder := NewAhoCorasickBuilder(Opts{})
+	ac := builder.Build([]string{"ab", "abc", "bc"})
+	haystack := strings.Repeat("xabc", 200)
+
+	var matches []Match
+	iter := ac.Iter(haystack)
+	for m := iter.Next(); m != nil; m = iter.Next() {
+		matches = append(matches, *m)
+	}
+	if expected := ac.FindAll(haystack); !reflect.DeepEqual(matches, expected) {
+		t.Errorf("expected %v matches got %v", len(expected), len(matches))
+	}
+
+	var overlapping []Match
+	iter = ac.IterOverlapping(haystack)
+	for m := iter.Next(); m != nil; m = iter.Next() {
+		overlapping = append(overlapping, *m)
+	}
+	if len(overlapping) != 600 {
+		t.Fatalf("expected %v matches got %v", 600, len(overlapping))
+	}
+	if m := overlapping[599]; m.End() != 800 {
+		t.Errorf("unexpected last match %v", m)
+	}
+
+	iter = ac.Iter(haystack)
+	for i := 0; i < 70; i++ {
+		if m := iter.Next(); m == nil || m.Start() != i*4+1 {
+			t.Fatalf("test %v unexpected match %v", i, m)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if m := iter.Next(); m != nil {
+		t.Errorf("expected no match after closing iterator got %v", m)
+	}
+}
+
+func TestAhoCorasick_Context(t *testing.T) {
+	builder := NewAhoCorasickBuilder(Opts{})
+	ac := builder.Build([]string{"ab", "abc", "bc"})
+	haystack := strings.Repeat("xabc", 200)
+
+	matches, err := ac.FindAllContext(context.Background(), haystack)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if expected := ac.FindAll(haystack); !reflect.DeepEqual(matches, expected) {
+		t.Errorf("expected %v matches got %v", len(expected), len(matches))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ac.FindAllContext(ctx, haystack); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	iters := []ContextIter{ac.IterContext(ctx, haystack), ac.IterOverlappingContext(ctx, haystack)}
+	for _, iter := range iters {
+		if m := iter.Next(); m == nil {
+			t.Fatalf("expected a match")
+		}
+	}
+	cancel()
+	for _, iter := range iters {
+		// Matches of the batch already searched are still returned.
+		n := 0
+		for m := iter.Next(); m != nil; m = iter.Next() {
+			n++
+		}
+		if n >= 200 {
+			t.Errorf("expected iteration to stop after cancel got %v matches", n)
+		}
+		if err := iter.Err(); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled got %v", err)
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	if err := Warmup(context.Background()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Warmup(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
 func TestAhoCorasick_IterOverlapping(t *testing.T) {
 	builder := NewAhoCorasickBuilder(Opts{
 		AsciiCaseInsensitive: true,
@@ -293,6 +735,708 @@ func TestAhoCorasick_LeftmostInsensitiveWholeWord_N(t *testing.T) {
 	}
 }
 
+func TestAhoCorasick_WholeWordUnicode(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		haystack string
+		starts   []int
+	}{
+		{
+			name:     "cjk",
+			patterns: []string{"本"},
+			haystack: "日本 本",
+			starts:   []int{7},
+		},
+		{
+			name:     "symbol",
+			patterns: []string{"bar"},
+			haystack: "bar€ €bar",
+			starts:   []int{0, 10},
+		},
+		{
+			name:     "accent",
+			patterns: []string{"caf"},
+			haystack: "café caf",
+			starts:   []int{6},
+		},
+		{
+			name:     "combining accent",
+			patterns: []string{"cafe"},
+			haystack: "cafe\u0301 cafe",
+			starts:   []int{7},
+		},
+		{
+			name:     "cyrillic",
+			patterns: []string{"мир"},
+			haystack: "мир, миру мир",
+			starts:   []int{0, 17},
+		},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.name, func(t *testing.T) {
+			for _, kind := range []automatonKind{NoncontiguousNFA, ContiguousNFA, DFA} {
+				ac := NewAhoCorasickBuilder(Opts{
+					MatchOnlyWholeWords: true,
+					Kind:                kind,
+				}).Build(tt.patterns)
+
+				var findAll, iter, overlapping []int
+				for _, m := range ac.FindAll(tt.haystack) {
+					findAll = append(findAll, m.Start())
+				}
+				it := ac.Iter(tt.haystack)
+				for m := it.Next(); m != nil; m = it.Next() {
+					iter = append(iter, m.Start())
+				}
+				it = ac.IterOverlapping(tt.haystack)
+				for m := it.Next(); m != nil; m = it.Next() {
+					overlapping = append(overlapping, m.Start())
+				}
+
+				for _, starts := range [][]int{findAll, iter, overlapping} {
+					if !reflect.DeepEqual(starts, tt.starts) {
+						t.Errorf("kind %v expected matches at %v got %v", kind, tt.starts, starts)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAhoCorasick_WordBoundary(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Opts
+		patterns []string
+		haystack string
+		starts   []int
+	}{
+		{
+			name:     "letter digit",
+			patterns: []string{"foo"},
+			haystack: "foo_bar foo-bar foo2",
+			starts:   []int{0, 8},
+		},
+		{
+			name:     "regexp",
+			opts:     Opts{WordBoundary: RegexpBoundary},
+			patterns: []string{"foo"},
+			haystack: "foo_bar foo-bar foo2",
+			starts:   []int{8},
+		},
+		{
+			name:     "unicode",
+			opts:     Opts{WordBoundary: UnicodeBoundary},
+			patterns: []string{"can", "t"},
+			haystack: "can't can t",
+			starts:   []int{6, 10},
+		},
+		{
+			name: "custom",
+			opts: Opts{IsWordRune: func(r rune) bool {
+				return r == '-' || unicode.IsLetter(r)
+			}},
+			patterns: []string{"foo"},
+			haystack: "foo-bar foo.bar foo1",
+			starts:   []int{8, 16},
+		},
+		{
+			name: "prefix",
+			opts: Opts{IsRightWordRune: func(r rune) bool {
+				return false
+			}},
+			patterns: []string{"foo"},
+			haystack: "foobar xfoo foo",
+			starts:   []int{0, 12},
+		},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.MatchOnlyWholeWords = true
+			ac := NewAhoCorasickBuilder(opts).Build(tt.patterns)
+
+			var findAll, iter, overlapping, stream []int
+			for _, m := range ac.FindAll(tt.haystack) {
+				findAll = append(findAll, m.Start())
+			}
+			it := ac.Iter(tt.haystack)
+			for m := it.Next(); m != nil; m = it.Next() {
+				iter = append(iter, m.Start())
+			}
+			it = ac.IterOverlapping(tt.haystack)
+			for m := it.Next(); m != nil; m = it.Next() {
+				overlapping = append(overlapping, m.Start())
+			}
+			sit := ac.StreamFind(iotest.OneByteReader(strings.NewReader(tt.haystack)))
+			for m := sit.Next(); m != nil; m = sit.Next() {
+				stream = append(stream, m.Start())
+			}
+
+			for _, starts := range [][]int{findAll, iter, overlapping, stream} {
+				if !reflect.DeepEqual(starts, tt.starts) {
+					t.Errorf("expected matches at %v got %v", tt.starts, starts)
+				}
+			}
+		})
+	}
+}
+
+func TestAhoCorasick_WholeWordLeftmost(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		haystack string
+		matches  []Match
+	}{
+		{
+			name:     "shorter at same start",
+			patterns: []string{"foo", "foo bar"},
+			haystack: "foo barn",
+			matches:  []Match{{pattern: 0, start: 0, end: 3}},
+		},
+		{
+			name:     "overlapping later start",
+			patterns: []string{"foo bar", "bar baz"},
+			haystack: "xfoo bar baz",
+			matches:  []Match{{pattern: 1, start: 5, end: 12}},
+		},
+		{
+			// More matches that are not whole words than fit in a batch precede the whole word.
+			name:     "many at same start",
+			patterns: []string{"ab", "abb", "abbb", "abbbb", "abbbbb", "abbbbbb", "abbbbbbb", "abbbbbbbb", "abbbbbbbbb", "abbbbbbbbbb", "abbbbbbbbbbbx"},
+			haystack: "abbbbbbbbbbbx",
+			matches:  []Match{{pattern: 10, start: 0, end: 13}},
+		},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.name, func(t *testing.T) {
+			for _, matchKind := range []matchKind{LeftMostLongestMatch, LeftMostFirstMatch} {
+				ac := NewAhoCorasickBuilder(Opts{
+					MatchOnlyWholeWords: true,
+					MatchKind:           matchKind,
+				}).Build(tt.patterns)
+				if matches := ac.FindAll(tt.haystack); !reflect.DeepEqual(matches, tt.matches) {
+					t.Errorf("match kind %v expected %v got %v", matchKind, tt.matches, matches)
+				}
+			}
+		})
+	}
+}
+
+func TestAhoCorasick_WholeWordStandardN(t *testing.T) {
+	// More matches that are not whole words than fit in a batch precede the whole words.
+	haystack := strings.Repeat("xfoo ", 100) + "foo FOO"
+	for _, opts := range []Opts{
+		{MatchOnlyWholeWords: true},
+		{MatchOnlyWholeWords: true, UnicodeCaseInsensitive: true},
+	} {
+		ac := NewAhoCorasickBuilder(opts).Build([]string{"foo"})
+
+		expected := []Match{{pattern: 0, start: 500, end: 503}}
+		if matches := ac.FindN(haystack, 1); !reflect.DeepEqual(matches, expected) {
+			t.Errorf("opts %+v expected %v got %v", opts, expected, matches)
+		}
+		if opts.UnicodeCaseInsensitive {
+			expected = append(expected, Match{pattern: 0, start: 504, end: 507})
+		}
+		if matches := ac.FindN(haystack, 2); !reflect.DeepEqual(matches, expected) {
+			t.Errorf("opts %+v expected %v got %v", opts, expected, matches)
+		}
+	}
+}
+
+// TestAhoCorasick_WholeWordDifferential compares whole word matches with leftmost semantics to a
+// naive search for the preferred whole word at the leftmost position.
+func TestAhoCorasick_WholeWordDifferential(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randString := func(alphabet string, minLen int, maxLen int) string {
+		b := make([]byte, minLen+r.Intn(maxLen-minLen+1))
+		for i := range b {
+			b[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	for i := 0; i < 300; i++ {
+		patterns := make([]string, 1+r.Intn(6))
+		for j := range patterns {
+			patterns[j] = randString("ab ", 1, 4)
+		}
+		haystack := randString("abAB ", 0, 30)
+		asciiCaseInsensitive := r.Intn(2) == 0
+
+		for _, matchKind := range []matchKind{LeftMostLongestMatch, LeftMostFirstMatch} {
+			expected := wholeWordLeftmost(patterns, haystack, matchKind, asciiCaseInsensitive)
+			for _, kind := range []automatonKind{NoncontiguousNFA, DFA} {
+				ac := NewAhoCorasickBuilder(Opts{
+					AsciiCaseInsensitive: asciiCaseInsensitive,
+					MatchOnlyWholeWords:  true,
+					MatchKind:            matchKind,
+					Kind:                 kind,
+				}).Build(patterns)
+
+				if matches := ac.FindAll(haystack); !reflect.DeepEqual(matches, expected) {
+					t.Fatalf("patterns %q haystack %q match kind %v: expected %v got %v", patterns, haystack, matchKind, expected, matches)
+				}
+				var iter []Match
+				it := ac.Iter(haystack)
+				for m := it.Next(); m != nil; m = it.Next() {
+					iter = append(iter, *m)
+				}
+				if len(iter) != len(expected) || len(iter) > 0 && !reflect.DeepEqual(iter, expected) {
+					t.Fatalf("patterns %q haystack %q match kind %v: expected %v got %v from Iter", patterns, haystack, matchKind, expected, iter)
+				}
+				if matches := ac.FindN(haystack, 1); len(expected) > 0 && !reflect.DeepEqual(matches, expected[:1]) {
+					t.Fatalf("patterns %q haystack %q match kind %v: expected %v got %v from FindN", patterns, haystack, matchKind, expected[:1], matches)
+				}
+				if ac.IsMatch(haystack) != (len(expected) > 0) {
+					t.Fatalf("patterns %q haystack %q match kind %v: expected IsMatch %v", patterns, haystack, matchKind, len(expected) > 0)
+				}
+			}
+		}
+	}
+}
+
+// wholeWordLeftmost finds the whole words with the smallest start, preferring the longest or first
+// pattern, the same as leftmost semantics as if no other matches existed.
+func wholeWordLeftmost(patterns []string, haystack string, matchKind matchKind, asciiCaseInsensitive bool) []Match {
+	words := newWordBoundaries(Opts{}).filter(haystack)
+	matches := []Match{}
+	for pos := 0; pos < len(haystack); {
+		var found *Match
+		for start := pos; start < len(haystack) && found == nil; start++ {
+			for i, p := range patterns {
+				end := start + len(p)
+				if end > len(haystack) || words.isNotWholeWord(start, end) {
+					continue
+				}
+				if s := haystack[start:end]; s != p && !(asciiCaseInsensitive && strings.EqualFold(s, p)) {
+					continue
+				}
+				if found == nil || matchKind == LeftMostLongestMatch && end > found.end {
+					found = &Match{pattern: i, start: start, end: end}
+				}
+			}
+		}
+		if found == nil {
+			break
+		}
+		matches = append(matches, *found)
+		pos = found.end
+	}
+	return matches
+}
+
+func TestAhoCorasick_UnicodeCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		haystack string
+		matches  []Match
+	}{
+		{
+			name:     "cyrillic and german",
+			patterns: []string{"привет", "straße"},
+			haystack: "ПРИВЕТ мир, STRAẞE",
+			matches:  []Match{{pattern: 0, start: 0, end: 12}, {pattern: 1, start: 21, end: 29}},
+		},
+		{
+			name:     "kelvin sign",
+			patterns: []string{"kelvin"},
+			haystack: "1 \u212Aelvin",
+			matches:  []Match{{pattern: 0, start: 2, end: 10}},
+		},
+		{
+			name:     "greek final sigma",
+			patterns: []string{"σοφός"},
+			haystack: "ΣΟΦΌΣ",
+			matches:  []Match{{pattern: 0, start: 0, end: 10}},
+		},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.name, func(t *testing.T) {
+			ac := NewAhoCorasickBuilder(Opts{
+				UnicodeCaseInsensitive: true,
+			}).Build(tt.patterns)
+
+			if matches := ac.FindAll(tt.haystack); !reflect.DeepEqual(matches, tt.matches) {
+				t.Errorf("expected %v got %v", tt.matches, matches)
+			}
+
+			var iter []Match
+			it := ac.Iter(tt.haystack)
+			for m := it.Next(); m != nil; m = it.Next() {
+				iter = append(iter, *m)
+			}
+			if !reflect.DeepEqual(iter, tt.matches) {
+				t.Errorf("expected %v got %v from Iter", tt.matches, iter)
+			}
+
+			var stream []Match
+			sit := ac.StreamFind(iotest.OneByteReader(strings.NewReader(tt.haystack)))
+			for m := sit.Next(); m != nil; m = sit.Next() {
+				stream = append(stream, *m)
+			}
+			if !reflect.DeepEqual(stream, tt.matches) {
+				t.Errorf("expected %v got %v from StreamFind", tt.matches, stream)
+			}
+		})
+	}
+
+	ac := NewAhoCorasickBuilder(Opts{
+		UnicodeCaseInsensitive: true,
+	}).Build([]string{"größe"})
+	if res := NewReplacer(ac).ReplaceAll("GRÖẞE: 42", []string{"size"}); res != "size: 42" {
+		t.Errorf("unexpected replacement %q", res)
+	}
+}
+
+func TestAhoCorasick_Normalization(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Opts
+		patterns []string
+		haystack string
+		matches  []Match
+	}{
+		{
+			name:     "nfc decomposed haystack",
+			opts:     Opts{Normalization: NFC},
+			patterns: []string{"café"},
+			haystack: "un cafe\u0301 noir",
+			matches:  []Match{{pattern: 0, start: 3, end: 9}},
+		},
+		{
+			name:     "nfc decomposed pattern",
+			opts:     Opts{Normalization: NFC},
+			patterns: []string{"cafe\u0301", "e"},
+			haystack: "un café, e",
+			matches:  []Match{{pattern: 0, start: 3, end: 8}, {pattern: 1, start: 10, end: 11}},
+		},
+		{
+			name:     "nfkc ligature",
+			opts:     Opts{Normalization: NFKC},
+			patterns: []string{"fish"},
+			haystack: "a \uFB01sh",
+			matches:  []Match{{pattern: 0, start: 2, end: 7}},
+		},
+		{
+			name:     "nfkc partial ligature",
+			opts:     Opts{Normalization: NFKC},
+			patterns: []string{"f"},
+			haystack: "\uFB01",
+			matches:  []Match{{pattern: 0, start: 0, end: 3}},
+		},
+		{
+			name:     "nfkc full width case insensitive",
+			opts:     Opts{Normalization: NFKC, UnicodeCaseInsensitive: true},
+			patterns: []string{"abc"},
+			haystack: "x ＡＢＣ",
+			matches:  []Match{{pattern: 0, start: 2, end: 11}},
+		},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.name, func(t *testing.T) {
+			ac := NewAhoCorasickBuilder(tt.opts).Build(tt.patterns)
+
+			if matches := ac.FindAll(tt.haystack); !reflect.DeepEqual(matches, tt.matches) {
+				t.Errorf("expected %v got %v", tt.matches, matches)
+			}
+
+			var iter []Match
+			it := ac.Iter(tt.haystack)
+			for m := it.Next(); m != nil; m = it.Next() {
+				iter = append(iter, *m)
+			}
+			if !reflect.DeepEqual(iter, tt.matches) {
+				t.Errorf("expected %v got %v from Iter", tt.matches, iter)
+			}
+
+			var overlapping []Match
+			oit := ac.IterOverlapping(tt.haystack)
+			for m := oit.Next(); m != nil; m = oit.Next() {
+				overlapping = append(overlapping, *m)
+			}
+			if !reflect.DeepEqual(overlapping, tt.matches) {
+				t.Errorf("expected %v got %v from IterOverlapping", tt.matches, overlapping)
+			}
+		})
+	}
+
+	ac := NewAhoCorasickBuilder(Opts{
+		Normalization:       NFC,
+		MatchOnlyWholeWords: true,
+		MatchKind:           LeftMostLongestMatch,
+	}).Build([]string{"résumé", "r"})
+	haystack := "re\u0301sume\u0301 r"
+	expected := []Match{{pattern: 0, start: 0, end: 10}, {pattern: 1, start: 11, end: 12}}
+	if matches := ac.FindAll(haystack); !reflect.DeepEqual(matches, expected) {
+		t.Errorf("expected %v got %v", expected, matches)
+	}
+
+	ac = NewAhoCorasickBuilder(Opts{
+		Normalization: NFC,
+	}).Build([]string{"résumé"})
+	sit := ac.StreamFind(strings.NewReader(haystack))
+	if m := sit.Next(); m != nil {
+		t.Errorf("unexpected match %v from StreamFind", m)
+	}
+	if err := sit.Err(); err != ErrStreamUnsupportedNormalization {
+		t.Errorf("expected ErrStreamUnsupportedNormalization got %v", err)
+	}
+}
+
+func TestAhoCorasick_Kind(t *testing.T) {
+	for i, t2 := range leftmostInsensitiveWholeWordTestCases {
+		for _, kind := range []automatonKind{AutoKind, NoncontiguousNFA, ContiguousNFA, DFA} {
+			builder := NewAhoCorasickBuilder(Opts{
+				AsciiCaseInsensitive: true,
+				MatchOnlyWholeWords:  true,
+				MatchKind:            LeftMostLongestMatch,
+				Kind:                 kind,
+			})
+
+			ac := builder.Build(t2.patterns)
+			matches := ac.FindAll(t2.haystack)
+			if !reflect.DeepEqual(matches, t2.matches) {
+				t.Errorf("test %v kind %v expected %v matches got %v", i, kind, t2.matches, matches)
+			}
+		}
+	}
+}
+
+func TestAhoCorasick_FindAnchored(t *testing.T) {
+	haystack := "The Bear and Masha and bears"
+	tests := []struct {
+		at       int
+		expected *Match
+	}{
+		{at: 0, expected: nil},
+		{at: 4, expected: &Match{pattern: 0, start: 4, end: 8}},
+		{at: 5, expected: nil},
+		{at: 13, expected: &Match{pattern: 1, start: 13, end: 18}},
+		// Not a whole word
+		{at: 23, expected: nil},
+	}
+
+	for _, startKind := range []startKind{AnchoredStart, BothStart} {
+		builder := NewAhoCorasickBuilder(Opts{
+			AsciiCaseInsensitive: true,
+			MatchOnlyWholeWords:  true,
+			MatchKind:            LeftMostLongestMatch,
+			StartKind:            startKind,
+		})
+
+		ac := builder.Build([]string{"bear", "masha"})
+		for _, tc := range tests {
+			if m := ac.FindAnchored(haystack, tc.at); !reflect.DeepEqual(m, tc.expected) {
+				t.Errorf("start kind %v at %v expected %v got %v", startKind, tc.at, tc.expected, m)
+			}
+		}
+	}
+}
+
+func TestAhoCorasick_Span(t *testing.T) {
+	builder := NewAhoCorasickBuilder(Opts{
+		AsciiCaseInsensitive: true,
+		MatchOnlyWholeWords:  true,
+		MatchKind:            LeftMostLongestMatch,
+	})
+
+	ac := builder.Build([]string{"bear", "masha"})
+	haystack := "xbear bear and Masha"
+
+	tests := []struct {
+		start    int
+		end      int
+		expected []Match
+	}{
+		// Word boundaries are checked against the entire haystack
+		{start: 1, end: 10, expected: []Match{{pattern: 0, start: 6, end: 10}}},
+		{start: 6, end: 20, expected: []Match{{pattern: 0, start: 6, end: 10}, {pattern: 1, start: 15, end: 20}}},
+		{start: 7, end: 20, expected: []Match{{pattern: 1, start: 15, end: 20}}},
+		{start: 6, end: 19, expected: []Match{{pattern: 0, start: 6, end: 10}}},
+	}
+
+	for _, tc := range tests {
+		if matches := ac.FindAllSpan(haystack, tc.start, tc.end); !reflect.DeepEqual(matches, tc.expected) {
+			t.Errorf("span %v-%v expected %v got %v", tc.start, tc.end, tc.expected, matches)
+		}
+
+		iter := ac.IterSpan(haystack, tc.start, tc.end)
+		matches := make([]Match, 0)
+		for next := iter.Next(); next != nil; next = iter.Next() {
+			matches = append(matches, *next)
+		}
+		if !reflect.DeepEqual(matches, tc.expected) {
+			t.Errorf("span %v-%v expected %v got %v", tc.start, tc.end, tc.expected, matches)
+		}
+	}
+
+	expected := []Match{{pattern: 0, start: 6, end: 10}}
+	if matches := ac.FindNSpan(haystack, 6, 20, 1); !reflect.DeepEqual(matches, expected) {
+		t.Errorf("expected %v got %v", expected, matches)
+	}
+}
+
+func TestAhoCorasick_IsMatch(t *testing.T) {
+	tests := []struct {
+		haystack           string
+		expected           bool
+		expectedWholeWords bool
+	}{
+		{haystack: "The Bear and Masha", expected: true, expectedWholeWords: true},
+		{haystack: "The Bears and Mashas", expected: true, expectedWholeWords: false},
+		{haystack: "The Bears and Masha", expected: true, expectedWholeWords: true},
+		{haystack: "", expected: false, expectedWholeWords: false},
+	}
+
+	for _, matchOnlyWholeWords := range []bool{false, true} {
+		builder := NewAhoCorasickBuilder(Opts{
+			AsciiCaseInsensitive: true,
+			MatchOnlyWholeWords:  matchOnlyWholeWords,
+			MatchKind:            LeftMostLongestMatch,
+		})
+
+		ac := builder.Build([]string{"bear", "masha"})
+		for _, tc := range tests {
+			expected := tc.expected
+			if matchOnlyWholeWords {
+				expected = tc.expectedWholeWords
+			}
+			if isMatch := ac.IsMatch(tc.haystack); isMatch != expected {
+				t.Errorf("whole words %v haystack %q expected %v got %v", matchOnlyWholeWords, tc.haystack, expected, isMatch)
+			}
+		}
+	}
+}
+
+func TestAhoCorasick_Close(t *testing.T) {
+	t2 := leftmostInsensitiveWholeWordTestCases[0]
+	builder := NewAhoCorasickBuilder(Opts{
+		AsciiCaseInsensitive: true,
+		MatchOnlyWholeWords:  true,
+		MatchKind:            StandardMatch,
+	})
+
+	ac := builder.Build(t2.patterns)
+	iter := ac.Iter(t2.haystack)
+	if next := iter.Next(); next == nil || *next != t2.matches[0] {
+		t.Errorf("expected %v got %v", t2.matches[0], next)
+	}
+
+	closedIter := ac.Iter(t2.haystack)
+	if err := closedIter.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if next := closedIter.Next(); next != nil {
+		t.Errorf("expected no match after closing iterator got %v", next)
+	}
+
+	if err := ac.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := ac.Close(); err != nil {
+		t.Fatalf("unexpected error closing twice %v", err)
+	}
+
+	// Methods without an error result panic instead of returning no matches.
+	expectClosed := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			if r := recover(); r != ErrClosed {
+				t.Errorf("expected %s to panic with ErrClosed got %v", name, r)
+			}
+		}()
+		f()
+	}
+	expectClosed("Next", func() { iter.Next() })
+	if err := iter.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectClosed("FindAll", func() { ac.FindAll(t2.haystack) })
+	expectClosed("IsMatch", func() { ac.IsMatch(t2.haystack) })
+	expectClosed("Stats", func() { ac.Stats() })
+	expectClosed("Iter", func() { ac.Iter(t2.haystack) })
+	expectClosed("IterOverlapping", func() { ac.IterOverlapping(t2.haystack) })
+	expectClosed("ReplaceAll", func() { NewReplacer(ac).ReplaceAll(t2.haystack, make([]string, len(t2.patterns))) })
+
+	stream := ac.StreamFind(strings.NewReader(t2.haystack))
+	if next := stream.Next(); next != nil {
+		t.Errorf("expected no match after closing matcher got %v", next)
+	}
+	if err := stream.Err(); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed got %v", err)
+	}
+
+	if _, err := ac.FindAllContext(context.Background(), t2.haystack); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed got %v", err)
+	}
+	closedCtxIter := ac.IterContext(context.Background(), t2.haystack)
+	if next := closedCtxIter.Next(); next != nil {
+		t.Errorf("expected no match after closing matcher got %v", next)
+	}
+	if err := closedCtxIter.Err(); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed got %v", err)
+	}
+}
+
+func TestAhoCorasick_ShareModule(t *testing.T) {
+	builder := NewAhoCorasickBuilder(Opts{
+		AsciiCaseInsensitive: true,
+		MatchOnlyWholeWords:  true,
+		MatchKind:            LeftMostLongestMatch,
+		ShareModule:          true,
+	})
+
+	acs := make([]AhoCorasick, 0, 100)
+	for i := 0; i < 100; i++ {
+		t2 := leftmostInsensitiveWholeWordTestCases[i%len(leftmostInsensitiveWholeWordTestCases)]
+		acs = append(acs, builder.Build(t2.patterns))
+	}
+
+	// Iterators outstanding when closing their matcher are deleted from the module once released.
+	var iters []Iter
+	for i, ac := range acs {
+		if i%2 == 0 {
+			t2 := leftmostInsensitiveWholeWordTestCases[i%len(leftmostInsensitiveWholeWordTestCases)]
+			iter := ac.Iter(t2.haystack)
+			iter.Next()
+			iters = append(iters, iter)
+			if err := ac.Close(); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+	}
+	for _, iter := range iters {
+		if err := iter.Close(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	for i, ac := range acs {
+		if i%2 == 0 {
+			continue
+		}
+		t2 := leftmostInsensitiveWholeWordTestCases[i%len(leftmostInsensitiveWholeWordTestCases)]
+		if matches := ac.FindAll(t2.haystack); !reflect.DeepEqual(matches, t2.matches) {
+			t.Errorf("test %v expected %v matches got %v", i, t2.matches, matches)
+		}
+	}
+}
+
 var leftmostInsensitiveWholeWordTestCases = []testCase{
 	{
 		name:     "medium",
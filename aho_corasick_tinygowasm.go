@@ -6,18 +6,23 @@ package aho_corasick
 
 #include <stddef.h>
 
-void* new_matcher(void* patterns, void* lens, int num_patterns, int ascii_case_insensitive, int dfa, int match_kind);
+void* new_matcher(void* patterns, void* lens, int num_patterns, int ascii_case_insensitive, int kind, int match_kind, int start_kind, size_t dense_depth, int byte_classes, size_t max_memory, int prefixes, size_t* errorOut, size_t* errorLenOut, size_t* errorKindOut);
+void error_delete(void* error, size_t len);
 void delete_matcher(void* matcher);
+void matcher_stats(void* ac, size_t* statsOut);
 void* find_iter(void* ac, void* value, int value_len);
-int find_iter_next(void* iter, size_t* patternOut, size_t* startOut, size_t* endOut);
+size_t find_iter_next_batch(void* iter, size_t* matchesOut, size_t limit);
 void find_iter_delete(void* iter);
 
 void* overlapping_iter(void* ac, void* value, int value_len);
-int overlapping_iter_next(void* iter, size_t* patternOut, size_t* startOut, size_t* endOut);
+size_t overlapping_iter_next_batch(void* iter, size_t* matchesOut, size_t limit);
 void overlapping_iter_delete(void* iter);
 
-void* matches(void* ac, void* value, size_t value_len, size_t limit, size_t* numOut);
-void matches_delete(void* matches, size_t num);
+int is_match(void* ac, void* value, size_t value_len);
+int find_anchored(void* ac, void* value, size_t value_len, size_t* patternOut, size_t* startOut, size_t* endOut);
+size_t prefix_matches(void* ac, void* value, size_t value_len, size_t skip, size_t* matchesOut, size_t limit);
+
+size_t matches(void* ac, void* value, size_t value_len, size_t start, int resume, size_t* matchesOut, size_t limit);
 */
 import "C"
 
@@ -29,17 +34,68 @@ import (
 
 type ahoCorasickABI struct{}
 
-func newABI() *ahoCorasickABI {
-	return &ahoCorasickABI{}
+// initRuntime does nothing since there is no runtime to initialize without wazero.
+func initRuntime() error {
+	return nil
+}
+
+func newABI() (*ahoCorasickABI, error) {
+	return &ahoCorasickABI{}, nil
+}
+
+// sharedABI is the same as newABI since there are no modules to share without wazero.
+func sharedABI() (*ahoCorasickABI, error) {
+	return newABI()
 }
 
+// matcherPoolSupported is false since searches do not need to wait on each other without wazero.
+const matcherPoolSupported = false
+
 func (abi *ahoCorasickABI) startOperation(memorySize int) {
 }
 
+func (abi *ahoCorasickABI) tryStartOperation(memorySize int) bool {
+	return true
+}
+
 func (abi *ahoCorasickABI) endOperation() {
 }
 
-func (abi *ahoCorasickABI) newMatcher(patterns []string, patternBytes int, asciiCaseInsensitive bool, dfa bool, matchKind int) uintptr {
+// moduleClosed is always false since iterators are only released by deleting them without wazero.
+func (abi *ahoCorasickABI) moduleClosed() bool {
+	return false
+}
+
+func (abi *ahoCorasickABI) newMatcher(patterns []string, patternBytes int, asciiCaseInsensitive bool, kind int, matchKind int, startKind int, denseDepth int, byteClasses bool, maxMemory int, prefixes bool) (uintptr, error) {
+	patternsBuf, lens := patternsBuffer(patterns, patternBytes)
+
+	patternsSh := (*reflect.SliceHeader)(unsafe.Pointer(&patternsBuf))
+	lensSh := (*reflect.SliceHeader)(unsafe.Pointer(&lens))
+	aci := 0
+	if asciiCaseInsensitive {
+		aci = 1
+	}
+	bc := 0
+	if byteClasses {
+		bc = 1
+	}
+	pf := 0
+	if prefixes {
+		pf = 1
+	}
+	var errC, errLenC, errKindC C.size_t
+	ptr := C.new_matcher(unsafe.Pointer(patternsSh.Data), unsafe.Pointer(lensSh.Data), C.int(len(patterns)), C.int(aci), C.int(kind), C.int(matchKind), C.int(startKind), C.size_t(denseDepth), C.int(bc), C.size_t(maxMemory), C.int(pf), &errC, &errLenC, &errKindC)
+	runtime.KeepAlive(patterns)
+	if ptr == nil {
+		msg := string(unsafe.Slice((*byte)(unsafe.Pointer(uintptr(errC))), errLenC))
+		C.error_delete(unsafe.Pointer(uintptr(errC)), errLenC)
+		return 0, &BuildError{Kind: buildErrorKind(errKindC), msg: msg}
+	}
+	return uintptr(ptr), nil
+}
+
+// patternsBuffer returns the patterns concatenated in a buffer along with their lengths.
+func patternsBuffer(patterns []string, patternBytes int) ([]byte, []uintptr) {
 	patternsBuf := make([]byte, patternBytes)
 	lens := make([]uintptr, len(patterns))
 
@@ -50,20 +106,28 @@ func (abi *ahoCorasickABI) newMatcher(patterns []string, patternBytes int, ascii
 		lens[i] = uintptr(len(p))
 	}
 
-	patternsSh := (*reflect.SliceHeader)(unsafe.Pointer(&patternsBuf))
-	lensSh := (*reflect.SliceHeader)(unsafe.Pointer(&lens))
-	aci := 0
-	if asciiCaseInsensitive {
-		aci = 1
-	}
+	return patternsBuf, lens
+}
 
-	d := 0
-	if dfa {
-		d = 1
+func (abi *ahoCorasickABI) stats(ptr uintptr) Stats {
+	var res [8]C.size_t
+	C.matcher_stats(unsafe.Pointer(ptr), &res[0])
+
+	return Stats{
+		Kind:          automatonKind(res[0]),
+		MemoryUsage:   int(res[1]),
+		StateCount:    int(res[2]),
+		PatternCount:  int(res[3]),
+		MinPatternLen: int(res[4]),
+		MaxPatternLen: int(res[5]),
+		MatchKind:     matchKind(res[6]),
+		Prefilter:     res[7] != 0,
 	}
-	ptr := C.new_matcher(unsafe.Pointer(patternsSh.Data), unsafe.Pointer(lensSh.Data), C.int(len(patterns)), C.int(aci), C.int(d), C.int(matchKind))
-	runtime.KeepAlive(patterns)
-	return uintptr(ptr)
+}
+
+func (abi *ahoCorasickABI) close(ptr uintptr) error {
+	abi.deleteMatcher(ptr)
+	return nil
 }
 
 func (abi *ahoCorasickABI) deleteMatcher(ptr uintptr) {
@@ -75,13 +139,8 @@ func (abi *ahoCorasickABI) findIter(acPtr uintptr, value cString) uintptr {
 	return uintptr(ptr)
 }
 
-func (abi *ahoCorasickABI) findIterNext(iterPtr uintptr) (pattern int, start int, end int, ok bool) {
-	var patternC, startC, endC C.size_t
-	okC := C.find_iter_next(unsafe.Pointer(iterPtr), &patternC, &startC, &endC)
-	if okC > 0 {
-		ok = true
-	}
-	return int(patternC), int(startC), int(endC), ok
+func (abi *ahoCorasickABI) findIterNextBatch(iterPtr uintptr, batch []Match) int {
+	return int(C.find_iter_next_batch(unsafe.Pointer(iterPtr), matchesPtr(batch), C.size_t(len(batch))))
 }
 
 func (abi *ahoCorasickABI) findIterDelete(iterPtr uintptr) {
@@ -93,44 +152,93 @@ func (abi *ahoCorasickABI) overlappingIter(acPtr uintptr, value cString) uintptr
 	return uintptr(ptr)
 }
 
-func (abi *ahoCorasickABI) overlappingIterNext(iterPtr uintptr) (pattern int, start int, end int, ok bool) {
+func (abi *ahoCorasickABI) overlappingIterNextBatch(iterPtr uintptr, batch []Match) int {
+	return int(C.overlapping_iter_next_batch(unsafe.Pointer(iterPtr), matchesPtr(batch), C.size_t(len(batch))))
+}
+
+func (abi *ahoCorasickABI) overlappingIterDelete(iterPtr uintptr) {
+	C.overlapping_iter_delete(unsafe.Pointer(iterPtr))
+}
+
+func (abi *ahoCorasickABI) isMatch(acPtr uintptr, value cString) bool {
+	return C.is_match(unsafe.Pointer(acPtr), unsafe.Pointer(value.ptr), C.size_t(value.length)) > 0
+}
+
+func (abi *ahoCorasickABI) findAnchored(acPtr uintptr, value cString) (pattern int, start int, end int, ok bool) {
 	var patternC, startC, endC C.size_t
-	okC := C.overlapping_iter_next(unsafe.Pointer(iterPtr), &patternC, &startC, &endC)
+	okC := C.find_anchored(unsafe.Pointer(acPtr), unsafe.Pointer(value.ptr), C.size_t(value.length), &patternC, &startC, &endC)
 	if okC > 0 {
 		ok = true
 	}
 	return int(patternC), int(startC), int(endC), ok
 }
 
-func (abi *ahoCorasickABI) overlappingIterDelete(iterPtr uintptr) {
-	C.overlapping_iter_delete(unsafe.Pointer(iterPtr))
-}
-
-func (abi ahoCorasickABI) findN(iter uintptr, valueStr string, value cString, n int, matchWholeWords bool) []Match {
-	var resLen C.size_t
-	matchesPtr := C.matches(unsafe.Pointer(iter), unsafe.Pointer(value.ptr), C.size_t(value.length), C.size_t(n), &resLen)
-	defer C.matches_delete(matchesPtr, resLen)
+// findN returns up to n of the matches in value collected by f, or all of them if n is negative.
+// Matches are written in batches directly to the spare capacity of the returned slice, which starts
+// at firstBatchSize matches and only grows once it is filled.
+func (abi ahoCorasickABI) findN(acPtr uintptr, value cString, n int, f *matchFilter) []Match {
+	size := firstBatchSize
+	if n >= 0 && n < size {
+		size = n
+	}
+	matches := make([]Match, 0, size)
+	start, resume := 0, 0
+	for n < 0 || len(matches) < n {
+		if len(matches) == cap(matches) {
+			size := 2*len(matches) + firstBatchSize
+			if n >= 0 && n < size {
+				size = n
+			}
+			grown := make([]Match, len(matches), size)
+			copy(grown, matches)
+			matches = grown
+		}
+		limit := cap(matches) - len(matches)
+		if n >= 0 && n-len(matches) < limit {
+			limit = n - len(matches)
+		}
 
-	res := unsafe.Slice((*uintptr)(unsafe.Pointer(matchesPtr)), resLen)
+		batch := matches[len(matches) : len(matches)+limit]
+		num := int(C.matches(unsafe.Pointer(acPtr), unsafe.Pointer(value.ptr), C.size_t(value.length), C.size_t(start), C.int(resume), matchesPtr(batch), C.size_t(limit)))
+		done := num < limit
+		if !done {
+			// Continue after the last match.
+			start, resume = batch[num-1].end, 1
+		}
+		// Appending overwrites batch in place, never past the match being read.
+		for _, m := range batch[:num] {
+			var restart int
+			if matches, restart = f.add(matches, m); restart >= 0 {
+				// The rest of the batch may overlap matches that were hidden.
+				start, resume, done = restart, 0, restart > value.length
+				break
+			}
+		}
 
-	num := int(resLen) / 3
-	matches := make([]Match, 0, num)
-	for i := 0; i < num; i++ {
-		start := int(res[i*3+1])
-		end := int(res[i*3+2])
-		if matchWholeWords && isNotWholeWord(valueStr, start, end) {
-			continue
+		if done {
+			break
 		}
-		var m Match
-		m.pattern = int(res[i*3])
-		m.start = start
-		m.end = end
-		matches = append(matches, m)
 	}
 
 	return matches
 }
 
+// Match has the same layout as the pattern, start and end triples of size_t written by the library,
+// so they are written directly to the Match values.
+var (
+	_ [unsafe.Sizeof(Match{}) - 3*unsafe.Sizeof(C.size_t(0))]struct{}
+	_ [3*unsafe.Sizeof(C.size_t(0)) - unsafe.Sizeof(Match{})]struct{}
+)
+
+// matchesPtr returns the memory of matches for the library to write them to.
+func matchesPtr(matches []Match) *C.size_t {
+	return (*C.size_t)(unsafe.Pointer(unsafe.SliceData(matches)))
+}
+
+func (abi *ahoCorasickABI) prefixMatches(acPtr uintptr, value cString, skip int, batch []Match) int {
+	return int(C.prefix_matches(unsafe.Pointer(acPtr), unsafe.Pointer(value.ptr), C.size_t(value.length), C.size_t(skip), matchesPtr(batch), C.size_t(len(batch))))
+}
+
 type cString struct {
 	ptr    uintptr
 	length int
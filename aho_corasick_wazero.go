@@ -7,6 +7,9 @@ import (
 	_ "embed"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
+	"os"
 	"sync"
 
 	"github.com/tetratelabs/wazero"
@@ -23,21 +26,66 @@ var (
 var ahocorasickWasm []byte
 
 var (
+	wasmOnce     sync.Once
 	wasmRT       wazero.Runtime
 	wasmCompiled wazero.CompiledModule
+	wasmErr      error
 )
 
+// Runtime options set before the runtime is initialized, guarded by runtimeOptions.mu.
+var runtimeOptions struct {
+	mu          sync.Mutex
+	initialized bool
+	config      wazero.RuntimeConfig
+	runtime     wazero.Runtime
+}
+
+// SetRuntimeConfig sets the configuration of the wazero runtime matchers are instantiated in, for example
+// to select the interpreter or limit memory. The compilation cache directory from the environment is
+// not used with a custom configuration. It is only available when not using cgo or TinyGo.
+// It panics if the runtime is already initialized, see Warmup.
+func SetRuntimeConfig(config wazero.RuntimeConfig) {
+	runtimeOptions.mu.Lock()
+	defer runtimeOptions.mu.Unlock()
+
+	if runtimeOptions.initialized {
+		panic("runtime config must be set before building any matcher")
+	}
+	runtimeOptions.config = config
+	runtimeOptions.runtime = nil
+}
+
+// SetRuntime sets an existing wazero runtime for matchers to be instantiated in, for example one shared
+// with other WebAssembly modules. WASI is instantiated in the runtime if it is not already. The runtime
+// must not be closed while matchers are in use. It is only available when not using cgo or TinyGo.
+// It panics if the runtime is already initialized, see Warmup.
+func SetRuntime(rt wazero.Runtime) {
+	runtimeOptions.mu.Lock()
+	defer runtimeOptions.mu.Unlock()
+
+	if runtimeOptions.initialized {
+		panic("runtime must be set before building any matcher")
+	}
+	runtimeOptions.runtime = rt
+	runtimeOptions.config = nil
+}
+
 type ahoCorasickABI struct {
-	new_matcher             api.Function
-	delete_matcher          api.Function
-	find_iter               api.Function
-	find_iter_next          api.Function
-	find_iter_delete        api.Function
-	overlapping_iter        api.Function
-	overlapping_iter_next   api.Function
-	overlapping_iter_delete api.Function
-	matches                 api.Function
-	matches_delete          api.Function
+	new_matcher                 api.Function
+	delete_matcher              api.Function
+	error_delete                api.Function
+	memory_usage                api.Function
+	matcher_stats               api.Function
+	find_iter                   api.Function
+	find_iter_next_batch        api.Function
+	find_iter_delete            api.Function
+	overlapping_iter            api.Function
+	overlapping_iter_next_batch api.Function
+	overlapping_iter_delete     api.Function
+	is_match                    api.Function
+	find_anchored               api.Function
+	prefix_matches              api.Function
+	matches                     api.Function
 
 	malloc api.Function
 	free   api.Function
@@ -49,43 +97,168 @@ type ahoCorasickABI struct {
 
 	memory sharedMemory
 	mu     sync.Mutex
+	// closed is set once the module is closed, which releases everything in its memory. It is
+	// guarded by mu.
+	closed bool
+	// trapped is set once building a matcher trapped, after which the memory of the module may be
+	// inconsistent. It is guarded by mu.
+	trapped bool
+
+	// shared is set for modules hosting many matchers, matchers and matchersMemory
+	// track their usage and are guarded by sharedModules.mu.
+	shared         bool
+	matchers       int
+	matchersMemory int
 }
 
-func init() {
-	ctx := context.Background()
-	rt := wazero.NewRuntime(ctx)
+// sharedModuleMemoryLimit is the memory used by the matchers of a shared module after which
+// new matchers are built in a new module. Memory of a wasm module never shrinks, so this bounds
+// the memory kept alive by a shared module until all of its matchers are closed.
+const sharedModuleMemoryLimit = 64 * 1024 * 1024
+
+var sharedModules struct {
+	mu      sync.Mutex
+	current *ahoCorasickABI
+}
+
+// compilationCacheDirEnv is the environment variable with a directory to cache the compiled WebAssembly
+// module in, which speeds up starting programs after the first run. The cache is not used when unset.
+const compilationCacheDirEnv = "GO_AHO_CORASICK_COMPILATION_CACHE_DIR"
+
+// initRuntime compiles the module the first time it is called, returning any error compiling it.
+func initRuntime() error {
+	wasmOnce.Do(func() {
+		ctx := context.Background()
+
+		runtimeOptions.mu.Lock()
+		runtimeOptions.initialized = true
+		config, rt := runtimeOptions.config, runtimeOptions.runtime
+		runtimeOptions.mu.Unlock()
 
-	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+		if rt != nil {
+			wasmRT = rt
+			wasmCompiled, wasmErr = compileModule(ctx, rt)
+			return
+		}
+
+		if config == nil {
+			if dir := os.Getenv(compilationCacheDirEnv); dir != "" {
+				if rt, code, err := newRuntime(ctx, wazero.NewRuntimeConfig(), dir); err == nil {
+					wasmRT, wasmCompiled = rt, code
+					return
+				}
+				// The cache cannot be used, for example if the directory is not writable, so compile without it.
+			}
+			config = wazero.NewRuntimeConfig()
+		}
+
+		wasmRT, wasmCompiled, wasmErr = newRuntime(ctx, config, "")
+	})
+	return wasmErr
+}
+
+// newRuntime creates a runtime with config and compiles the embedded module with it, using the
+// compilation cache in cacheDir if it is not empty.
+func newRuntime(ctx context.Context, config wazero.RuntimeConfig, cacheDir string) (wazero.Runtime, wazero.CompiledModule, error) {
+	if cacheDir != "" {
+		cache, err := wazero.NewCompilationCacheWithDir(cacheDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		config = config.WithCompilationCache(cache)
+	}
+	rt := wazero.NewRuntimeWithConfig(ctx, config)
+
+	code, err := compileModule(ctx, rt)
+	if err != nil {
+		_ = rt.Close(ctx)
+		return nil, nil, err
+	}
+
+	return rt, code, nil
+}
+
+// compileModule compiles the embedded module in rt, instantiating WASI in it if needed.
+func compileModule(ctx context.Context, rt wazero.Runtime) (wazero.CompiledModule, error) {
+	if rt.Module(wasi_snapshot_preview1.ModuleName) == nil {
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+			return nil, err
+		}
+	}
 
 	code, err := rt.CompileModule(ctx, ahocorasickWasm)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := checkExports(code); err != nil {
+		_ = code.Close(ctx)
+		return nil, err
 	}
-	wasmCompiled = code
+	return code, nil
+}
+
+// newMatcherParams is the number of parameters of the new_matcher export.
+const newMatcherParams = 14
 
-	wasmRT = rt
+// exportParams is the number of parameters of exports whose signature changed, to detect modules
+// built from an older Rust library.
+var exportParams = map[string]int{
+	"new_matcher":   newMatcherParams,
+	"matcher_stats": 2,
+	"matches":       7,
+}
+
+// checkExports returns an error if the module does not export the functions used by matchers, which
+// happens when the embedded module was not rebuilt after changing the Rust library.
+func checkExports(code wazero.CompiledModule) error {
+	exports := code.ExportedFunctions()
+	for _, name := range []string{
+		"new_matcher", "delete_matcher", "error_delete", "memory_usage", "matcher_stats",
+		"find_iter", "find_iter_next_batch", "find_iter_delete",
+		"overlapping_iter", "overlapping_iter_next_batch", "overlapping_iter_delete",
+		"is_match", "find_anchored", "prefix_matches", "matches", "malloc", "free",
+	} {
+		if _, ok := exports[name]; !ok {
+			return fmt.Errorf("aho_corasick: wasm module does not export %s, it must be rebuilt with mage updateLibs", name)
+		}
+	}
+	for name, want := range exportParams {
+		if n := len(exports[name].ParamTypes()); n != want {
+			return fmt.Errorf("aho_corasick: wasm module exports %s with %d parameters instead of %d, it must be rebuilt with mage updateLibs", name, n, want)
+		}
+	}
+	return nil
 }
 
-func newABI() *ahoCorasickABI {
+func newABI() (*ahoCorasickABI, error) {
+	if err := initRuntime(); err != nil {
+		return nil, err
+	}
+
 	ctx := context.Background()
 	mod, err := wasmRT.InstantiateModule(ctx, wasmCompiled, wazero.NewModuleConfig().WithName(""))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	callStack := make([]uint64, 6)
+	callStack := make([]uint64, newMatcherParams)
 
 	return &ahoCorasickABI{
-		new_matcher:             mod.ExportedFunction("new_matcher"),
-		delete_matcher:          mod.ExportedFunction("delete_matcher"),
-		find_iter:               mod.ExportedFunction("find_iter"),
-		find_iter_next:          mod.ExportedFunction("find_iter_next"),
-		find_iter_delete:        mod.ExportedFunction("find_iter_delete"),
-		overlapping_iter:        mod.ExportedFunction("overlapping_iter"),
-		overlapping_iter_next:   mod.ExportedFunction("overlapping_iter_next"),
-		overlapping_iter_delete: mod.ExportedFunction("overlapping_iter_delete"),
-		matches:                 mod.ExportedFunction("matches"),
-		matches_delete:          mod.ExportedFunction("matches_delete"),
+		new_matcher:                 mod.ExportedFunction("new_matcher"),
+		delete_matcher:              mod.ExportedFunction("delete_matcher"),
+		error_delete:                mod.ExportedFunction("error_delete"),
+		memory_usage:                mod.ExportedFunction("memory_usage"),
+		matcher_stats:               mod.ExportedFunction("matcher_stats"),
+		find_iter:                   mod.ExportedFunction("find_iter"),
+		find_iter_next_batch:        mod.ExportedFunction("find_iter_next_batch"),
+		find_iter_delete:            mod.ExportedFunction("find_iter_delete"),
+		overlapping_iter:            mod.ExportedFunction("overlapping_iter"),
+		overlapping_iter_next_batch: mod.ExportedFunction("overlapping_iter_next_batch"),
+		overlapping_iter_delete:     mod.ExportedFunction("overlapping_iter_delete"),
+		is_match:                    mod.ExportedFunction("is_match"),
+		find_anchored:               mod.ExportedFunction("find_anchored"),
+		prefix_matches:              mod.ExportedFunction("prefix_matches"),
+		matches:                     mod.ExportedFunction("matches"),
 
 		malloc: mod.ExportedFunction("malloc"),
 		free:   mod.ExportedFunction("free"),
@@ -93,19 +266,197 @@ func newABI() *ahoCorasickABI {
 		wasmMemory: mod.Memory(),
 		mod:        mod,
 		callStack:  callStack,
+	}, nil
+}
+
+// sharedABI returns the module shared by matchers built with Opts.ShareModule, instantiating it
+// if needed.
+func sharedABI() (*ahoCorasickABI, error) {
+	sharedModules.mu.Lock()
+	defer sharedModules.mu.Unlock()
+
+	if sharedModules.current == nil {
+		abi, err := newABI()
+		if err != nil {
+			return nil, err
+		}
+		abi.shared = true
+		sharedModules.current = abi
+	}
+
+	abi := sharedModules.current
+	abi.matchers++
+	return abi, nil
+}
+
+// addMatcherMemory accounts for the memory used by a matcher built in a shared module.
+func (abi *ahoCorasickABI) addMatcherMemory(usage int) {
+	sharedModules.mu.Lock()
+	defer sharedModules.mu.Unlock()
+
+	abi.matchersMemory += usage
+	if abi.matchersMemory >= sharedModuleMemoryLimit && sharedModules.current == abi {
+		sharedModules.current = nil
+	}
+}
+
+// trap marks the module as trapped, so no more matchers are built in it when it is shared and it is
+// closed once its other matchers are released. The operation must be started.
+func (abi *ahoCorasickABI) trap() {
+	abi.trapped = true
+	if !abi.shared {
+		return
+	}
+
+	sharedModules.mu.Lock()
+	defer sharedModules.mu.Unlock()
+
+	if sharedModules.current == abi {
+		sharedModules.current = nil
+	}
+}
+
+// releaseModule is called when a matcher of the module is deleted or failed to build, closing
+// the module once no matcher uses it. usage is the memory that was used by the matcher.
+func (abi *ahoCorasickABI) releaseModule(usage int) error {
+	if !abi.shared {
+		abi.closed = true
+		return abi.mod.Close(context.Background())
+	}
+
+	sharedModules.mu.Lock()
+	abi.matchers--
+	abi.matchersMemory -= usage
+	unused := abi.matchers == 0 && sharedModules.current != abi
+	sharedModules.mu.Unlock()
+
+	if unused {
+		abi.closed = true
+		return abi.mod.Close(context.Background())
 	}
+	return nil
 }
 
+// moduleClosed returns whether the module was closed along with any iterators in it. The operation
+// must be started.
+func (abi *ahoCorasickABI) moduleClosed() bool {
+	return abi.closed
+}
+
+// matcherPoolSupported is true since operations on a module instance are serialized, so searches from
+// multiple goroutines need copies of the matcher in separate instances to run in parallel.
+const matcherPoolSupported = true
+
 func (abi *ahoCorasickABI) startOperation(memorySize int) {
 	abi.mu.Lock()
 	abi.memory.reserve(abi, uint32(memorySize))
 }
 
+func (abi *ahoCorasickABI) tryStartOperation(memorySize int) bool {
+	if !abi.mu.TryLock() {
+		return false
+	}
+	abi.memory.reserve(abi, uint32(memorySize))
+	return true
+}
+
 func (abi *ahoCorasickABI) endOperation() {
 	abi.mu.Unlock()
 }
 
-func (abi *ahoCorasickABI) newMatcher(patterns []string, patternBytes int, asciiCaseInsensitive bool, dfa bool, matchKind int) uintptr {
+func (abi *ahoCorasickABI) newMatcher(patterns []string, patternBytes int, asciiCaseInsensitive bool, kind int, matchKind int, startKind int, denseDepth int, byteClasses bool, maxMemory int, prefixes bool) (uintptr, error) {
+	ptr, err := abi.buildMatcher(patterns, patternBytes, asciiCaseInsensitive, kind, matchKind, startKind, denseDepth, byteClasses, maxMemory, prefixes)
+	if err != nil {
+		if err.Kind == TrapError {
+			abi.trap()
+		}
+		_ = abi.releaseModule(0)
+		return 0, err
+	}
+
+	if abi.shared {
+		abi.addMatcherMemory(abi.memoryUsage(ptr))
+	}
+
+	return ptr, nil
+}
+
+func (abi *ahoCorasickABI) buildMatcher(patterns []string, patternBytes int, asciiCaseInsensitive bool, kind int, matchKind int, startKind int, denseDepth int, byteClasses bool, maxMemory int, prefixes bool) (uintptr, *BuildError) {
+	patternsPtr, lensPtr := abi.writePatterns(patterns, patternBytes)
+	errPtr := abi.memory.allocate(4)
+	errLenPtr := abi.memory.allocate(4)
+	errKindPtr := abi.memory.allocate(4)
+
+	aci := 0
+	if asciiCaseInsensitive {
+		aci = 1
+	}
+	bc := 0
+	if byteClasses {
+		bc = 1
+	}
+	pf := 0
+	if prefixes {
+		pf = 1
+	}
+	// Memory of the module cannot exceed 4GiB, so larger limits are the same as no limit.
+	if maxMemory > math.MaxUint32 {
+		maxMemory = 0
+	}
+
+	callStack := abi.callStack
+	callStack[0] = uint64(patternsPtr)
+	callStack[1] = uint64(lensPtr)
+	callStack[2] = uint64(len(patterns))
+	callStack[3] = uint64(aci)
+	callStack[4] = uint64(kind)
+	callStack[5] = uint64(matchKind)
+	callStack[6] = uint64(startKind)
+	callStack[7] = uint64(denseDepth)
+	callStack[8] = uint64(bc)
+	callStack[9] = uint64(maxMemory)
+	callStack[10] = uint64(pf)
+	callStack[11] = uint64(errPtr)
+	callStack[12] = uint64(errLenPtr)
+	callStack[13] = uint64(errKindPtr)
+	if err := abi.new_matcher.CallWithStack(context.Background(), callStack); err != nil {
+		// Allocation failures abort inside wasm.
+		return 0, &BuildError{Kind: TrapError, msg: err.Error()}
+	}
+
+	if ptr := uintptr(callStack[0]); ptr != 0 {
+		return ptr, nil
+	}
+
+	msgPtr, ok := abi.wasmMemory.ReadUint32Le(uint32(errPtr))
+	if !ok {
+		panic(errFailedRead)
+	}
+	msgLen, ok := abi.wasmMemory.ReadUint32Le(uint32(errLenPtr))
+	if !ok {
+		panic(errFailedRead)
+	}
+	msg, ok := abi.wasmMemory.Read(msgPtr, msgLen)
+	if !ok {
+		panic(errFailedRead)
+	}
+	errKind, ok := abi.wasmMemory.ReadUint32Le(uint32(errKindPtr))
+	if !ok {
+		panic(errFailedRead)
+	}
+	err := &BuildError{Kind: buildErrorKind(errKind), msg: string(msg)}
+
+	callStack[0] = uint64(msgPtr)
+	callStack[1] = uint64(msgLen)
+	if err := abi.error_delete.CallWithStack(context.Background(), callStack); err != nil {
+		panic(err)
+	}
+
+	return 0, err
+}
+
+// writePatterns copies the patterns and their lengths into the memory reserved for the current operation.
+func (abi *ahoCorasickABI) writePatterns(patterns []string, patternBytes int) (uintptr, uintptr) {
 	patternsPtr := abi.memory.allocate(uint32(patternBytes))
 	lensPtr := abi.memory.allocate(uint32(len(patterns) * 4))
 
@@ -120,28 +471,63 @@ func (abi *ahoCorasickABI) newMatcher(patterns []string, patternBytes int, ascii
 		abi.wasmMemory.WriteUint32Le(uint32(lensPtr)+uint32(i*4), uint32(len(p)))
 	}
 
-	aci := 0
-	if asciiCaseInsensitive {
-		aci = 1
+	return patternsPtr, lensPtr
+}
+
+func (abi *ahoCorasickABI) stats(ptr uintptr) Stats {
+	statsPtr := abi.memory.allocate(32)
+
+	callStack := abi.callStack
+	callStack[0] = uint64(ptr)
+	callStack[1] = uint64(statsPtr)
+	if err := abi.matcher_stats.CallWithStack(context.Background(), callStack); err != nil {
+		panic(err)
+	}
+
+	res, ok := abi.wasmMemory.Read(uint32(statsPtr), 32)
+	if !ok {
+		panic(errFailedRead)
+	}
+
+	return Stats{
+		Kind:          automatonKind(binary.LittleEndian.Uint32(res[0:])),
+		MemoryUsage:   int(binary.LittleEndian.Uint32(res[4:])),
+		StateCount:    int(binary.LittleEndian.Uint32(res[8:])),
+		PatternCount:  int(binary.LittleEndian.Uint32(res[12:])),
+		MinPatternLen: int(binary.LittleEndian.Uint32(res[16:])),
+		MaxPatternLen: int(binary.LittleEndian.Uint32(res[20:])),
+		MatchKind:     matchKind(binary.LittleEndian.Uint32(res[24:])),
+		Prefilter:     binary.LittleEndian.Uint32(res[28:]) != 0,
+	}
+}
+
+func (abi *ahoCorasickABI) close(ptr uintptr) error {
+	abi.mu.Lock()
+	defer abi.mu.Unlock()
+
+	if !abi.shared {
+		// The matcher and any iterators live in the module's memory, which is released with it.
+		abi.closed = true
+		return abi.mod.Close(context.Background())
 	}
 
-	d := 0
-	if dfa {
-		d = 1
+	if abi.trapped {
+		// Calling into the module could trap again, its memory is released once it is closed.
+		return abi.releaseModule(0)
 	}
+	usage := abi.memoryUsage(ptr)
+	abi.deleteMatcher(ptr)
+	return abi.releaseModule(usage)
+}
 
+func (abi *ahoCorasickABI) memoryUsage(ptr uintptr) int {
 	callStack := abi.callStack
-	callStack[0] = uint64(patternsPtr)
-	callStack[1] = uint64(lensPtr)
-	callStack[2] = uint64(len(patterns))
-	callStack[3] = uint64(aci)
-	callStack[4] = uint64(d)
-	callStack[5] = uint64(matchKind)
-	if err := abi.new_matcher.CallWithStack(context.Background(), callStack); err != nil {
+	callStack[0] = uint64(ptr)
+	if err := abi.memory_usage.CallWithStack(context.Background(), callStack); err != nil {
 		panic(err)
 	}
 
-	return uintptr(callStack[0])
+	return int(uint32(callStack[0]))
 }
 
 func (abi *ahoCorasickABI) deleteMatcher(ptr uintptr) {
@@ -164,38 +550,8 @@ func (abi *ahoCorasickABI) findIter(acPtr uintptr, value cString) uintptr {
 	return uintptr(callStack[0])
 }
 
-func (abi *ahoCorasickABI) findIterNext(iter uintptr) (int, int, int, bool) {
-	patternPtr := abi.memory.allocate(4)
-	startPtr := abi.memory.allocate(4)
-	endPtr := abi.memory.allocate(4)
-
-	callStack := abi.callStack
-	callStack[0] = uint64(iter)
-	callStack[1] = uint64(patternPtr)
-	callStack[2] = uint64(startPtr)
-	callStack[3] = uint64(endPtr)
-	if err := abi.find_iter_next.CallWithStack(context.Background(), callStack); err != nil {
-		panic(err)
-	}
-
-	if callStack[0] == 0 {
-		return 0, 0, 0, false
-	}
-
-	pattern, ok := abi.wasmMemory.ReadUint32Le(uint32(patternPtr))
-	if !ok {
-		panic(errFailedRead)
-	}
-	start, ok := abi.wasmMemory.ReadUint32Le(uint32(startPtr))
-	if !ok {
-		panic(errFailedRead)
-	}
-	end, ok := abi.wasmMemory.ReadUint32Le(uint32(endPtr))
-	if !ok {
-		panic(errFailedRead)
-	}
-
-	return int(pattern), int(start), int(end), true
+func (abi *ahoCorasickABI) findIterNextBatch(iter uintptr, batch []Match) int {
+	return abi.nextBatch(abi.find_iter_next_batch, iter, batch)
 }
 
 func (abi *ahoCorasickABI) findIterDelete(iter uintptr) {
@@ -218,29 +574,63 @@ func (abi *ahoCorasickABI) overlappingIter(acPtr uintptr, value cString) uintptr
 	return uintptr(callStack[0])
 }
 
-func (abi *ahoCorasickABI) overlappingIterNext(iter uintptr) (int, int, int, bool) {
-	patternPtr := abi.memory.allocate(4)
-	startPtr := abi.memory.allocate(4)
-	endPtr := abi.memory.allocate(4)
+func (abi *ahoCorasickABI) overlappingIterNextBatch(iter uintptr, batch []Match) int {
+	return abi.nextBatch(abi.overlapping_iter_next_batch, iter, batch)
+}
+
+// nextBatch reads up to len(batch) matches from the iterator with one call of the batch function,
+// returning the number of matches read. The operation must reserve 12 bytes per match of the batch.
+func (abi *ahoCorasickABI) nextBatch(f api.Function, iter uintptr, batch []Match) int {
+	resPtr := abi.memory.allocate(uint32(len(batch) * 12))
 
 	callStack := abi.callStack
 	callStack[0] = uint64(iter)
-	callStack[1] = uint64(patternPtr)
-	callStack[2] = uint64(startPtr)
-	callStack[3] = uint64(endPtr)
-	if err := abi.overlapping_iter_next.CallWithStack(context.Background(), callStack); err != nil {
+	callStack[1] = uint64(resPtr)
+	callStack[2] = uint64(len(batch))
+	if err := f.CallWithStack(context.Background(), callStack); err != nil {
 		panic(err)
 	}
 
-	if callStack[0] == 0 {
-		return 0, 0, 0, false
+	n := int(uint32(callStack[0]))
+	abi.readBatch(resPtr, batch[:n])
+	return n
+}
+
+// prefixMatches reads up to len(batch) of the matches starting at the beginning of value in the
+// order they are preferred, after skipping the first skip of them. The operation must reserve 12
+// bytes per match of the batch.
+func (abi *ahoCorasickABI) prefixMatches(acPtr uintptr, value cString, skip int, batch []Match) int {
+	resPtr := abi.memory.allocate(uint32(len(batch) * 12))
+
+	callStack := abi.callStack
+	callStack[0] = uint64(acPtr)
+	callStack[1] = uint64(value.ptr)
+	callStack[2] = uint64(value.length)
+	callStack[3] = uint64(skip)
+	callStack[4] = uint64(resPtr)
+	callStack[5] = uint64(len(batch))
+	if err := abi.prefix_matches.CallWithStack(context.Background(), callStack); err != nil {
+		panic(err)
 	}
 
-	pattern, _ := abi.wasmMemory.ReadUint32Le(uint32(patternPtr))
-	start, _ := abi.wasmMemory.ReadUint32Le(uint32(startPtr))
-	end, _ := abi.wasmMemory.ReadUint32Le(uint32(endPtr))
+	n := int(uint32(callStack[0]))
+	abi.readBatch(resPtr, batch[:n])
+	// The matches are read, so repeated calls reuse the memory.
+	abi.memory.free(uint32(len(batch) * 12))
+	return n
+}
 
-	return int(pattern), int(start), int(end), true
+// readBatch reads matches written as pattern, start and end triples at ptr.
+func (abi *ahoCorasickABI) readBatch(ptr uintptr, batch []Match) {
+	res, ok := abi.wasmMemory.Read(uint32(ptr), uint32(len(batch)*12))
+	if !ok {
+		panic(errFailedRead)
+	}
+	for i := range batch {
+		batch[i].pattern = int(binary.LittleEndian.Uint32(res[i*12:]))
+		batch[i].start = int(binary.LittleEndian.Uint32(res[i*12+4:]))
+		batch[i].end = int(binary.LittleEndian.Uint32(res[i*12+8:]))
+	}
 }
 
 func (abi *ahoCorasickABI) overlappingIterDelete(iter uintptr) {
@@ -251,67 +641,148 @@ func (abi *ahoCorasickABI) overlappingIterDelete(iter uintptr) {
 	}
 }
 
-func (abi *ahoCorasickABI) findN(iter uintptr, valueStr string, value cString, n int, matchWholeWords bool) []Match {
-	lenPtr := abi.memory.allocate(4)
+func (abi *ahoCorasickABI) isMatch(acPtr uintptr, value cString) bool {
+	callStack := abi.callStack
+	callStack[0] = uint64(acPtr)
+	callStack[1] = uint64(value.ptr)
+	callStack[2] = uint64(value.length)
+	if err := abi.is_match.CallWithStack(context.Background(), callStack); err != nil {
+		panic(err)
+	}
+
+	return callStack[0] != 0
+}
+
+func (abi *ahoCorasickABI) findAnchored(acPtr uintptr, value cString) (int, int, int, bool) {
+	patternPtr := abi.memory.allocate(4)
+	startPtr := abi.memory.allocate(4)
+	endPtr := abi.memory.allocate(4)
 
 	callStack := abi.callStack
-	callStack[0] = uint64(iter)
+	callStack[0] = uint64(acPtr)
 	callStack[1] = uint64(value.ptr)
 	callStack[2] = uint64(value.length)
-	callStack[3] = uint64(n)
-	callStack[4] = uint64(lenPtr)
-	if err := abi.matches.CallWithStack(context.Background(), callStack); err != nil {
+	callStack[3] = uint64(patternPtr)
+	callStack[4] = uint64(startPtr)
+	callStack[5] = uint64(endPtr)
+	if err := abi.find_anchored.CallWithStack(context.Background(), callStack); err != nil {
 		panic(err)
 	}
 
-	resLen, ok := abi.wasmMemory.ReadUint32Le(uint32(lenPtr))
+	if callStack[0] == 0 {
+		return 0, 0, 0, false
+	}
+
+	pattern, ok := abi.wasmMemory.ReadUint32Le(uint32(patternPtr))
+	if !ok {
+		panic(errFailedRead)
+	}
+	start, ok := abi.wasmMemory.ReadUint32Le(uint32(startPtr))
 	if !ok {
 		panic(errFailedRead)
 	}
+	end, ok := abi.wasmMemory.ReadUint32Le(uint32(endPtr))
+	if !ok {
+		panic(errFailedRead)
+	}
+
+	return int(pattern), int(start), int(end), true
+}
+
+// findN returns up to n of the matches in value collected by f, or all of them if n is negative.
+// Matches are read in batches of iterBatchSize matches, the operation must reserve 12 bytes per
+// match of a batch along with the memory f searches again with.
+func (abi *ahoCorasickABI) findN(acPtr uintptr, value cString, n int, f *matchFilter) []Match {
+	resPtr := abi.memory.allocate(iterBatchSize * 12)
+
+	matches := make([]Match, 0)
+	start, resume := 0, 0
+	for n < 0 || len(matches) < n {
+		limit := iterBatchSize
+		if n >= 0 && n-len(matches) < limit {
+			limit = n - len(matches)
+		}
 
-	resPtr := callStack[0]
-	defer func() {
-		callStack[0] = uint64(resPtr)
-		callStack[1] = uint64(resLen)
-		if err := abi.matches_delete.CallWithStack(context.Background(), callStack); err != nil {
+		callStack := abi.callStack
+		callStack[0] = uint64(acPtr)
+		callStack[1] = uint64(value.ptr)
+		callStack[2] = uint64(value.length)
+		callStack[3] = uint64(start)
+		callStack[4] = uint64(resume)
+		callStack[5] = uint64(resPtr)
+		callStack[6] = uint64(limit)
+		if err := abi.matches.CallWithStack(context.Background(), callStack); err != nil {
 			panic(err)
 		}
-	}()
 
-	res, ok := abi.wasmMemory.Read(uint32(resPtr), resLen*4)
-	if !ok {
-		panic(errFailedRead)
-	}
+		num := int(uint32(callStack[0]))
+		res, ok := abi.wasmMemory.Read(uint32(resPtr), uint32(num*12))
+		if !ok {
+			panic(errFailedRead)
+		}
+		restart := -1
+		for i := 0; i < num && restart < 0; i++ {
+			var m Match
+			m.pattern = int(binary.LittleEndian.Uint32(res[i*12:]))
+			m.start = int(binary.LittleEndian.Uint32(res[i*12+4:]))
+			m.end = int(binary.LittleEndian.Uint32(res[i*12+8:]))
+			matches, restart = f.add(matches, m)
+		}
 
-	num := resLen / 3
-	matches := make([]Match, 0, num)
-	for i := 0; i < int(num); i++ {
-		start := int(binary.LittleEndian.Uint32(res[i*12+4:]))
-		end := int(binary.LittleEndian.Uint32(res[i*12+8:]))
-		if matchWholeWords && isNotWholeWord(valueStr, start, end) {
+		if restart >= 0 {
+			// The rest of the batch may overlap matches that were hidden.
+			if restart > value.length {
+				break
+			}
+			start, resume = restart, 0
 			continue
 		}
-		var m Match
-		m.pattern = int(binary.LittleEndian.Uint32(res[i*12:]))
-		m.start = start
-		m.end = end
-		matches = append(matches, m)
+		if num < limit {
+			break
+		}
+		// Continue after the last match.
+		start, resume = int(binary.LittleEndian.Uint32(res[(num-1)*12+8:])), 1
 	}
 
 	return matches
 }
 
+const (
+	// sharedMemoryShrinkSize is the size of reserved memory above which it is shrunk after
+	// sharedMemoryShrinkAfter consecutive operations using less than a quarter of it. This
+	// releases memory used for the occasional large haystack to the allocator of the module.
+	sharedMemoryShrinkSize  = 64 * 1024
+	sharedMemoryShrinkAfter = 100
+)
+
+// sharedMemory is scratch memory reused by operations for their arguments and results, so
+// that steady-state operations do not need to allocate.
 type sharedMemory struct {
 	size    uint32
 	bufPtr  uint32
 	nextIdx uint32
+	// small counts consecutive operations using less than a quarter of a large reserved size.
+	small int
 }
 
 func (m *sharedMemory) reserve(abi *ahoCorasickABI, size uint32) {
 	m.nextIdx = 0
-	if m.size >= size {
+	// Operations without arguments or results, such as releasing an iterator after its module may
+	// have been closed, neither call into the module nor count towards shrinking.
+	if size == 0 {
 		return
 	}
+	if m.size >= size {
+		if m.size <= sharedMemoryShrinkSize || size >= m.size/4 {
+			m.small = 0
+			return
+		}
+		m.small++
+		if m.small < sharedMemoryShrinkAfter {
+			return
+		}
+	}
+	m.small = 0
 
 	ctx := context.Background()
 	callStack := abi.callStack
@@ -341,11 +812,28 @@ func (m *sharedMemory) allocate(size uint32) uintptr {
 	return uintptr(ptr)
 }
 
+// free releases the last size bytes allocated for the current operation.
+func (m *sharedMemory) free(size uint32) {
+	m.nextIdx -= size
+}
+
 type cString struct {
 	ptr    uintptr
 	length int
 }
 
+// newCString copies s into the memory reserved for the current operation.
+func (abi *ahoCorasickABI) newCString(s string) cString {
+	ptr := abi.memory.allocate(uint32(len(s)))
+	if !abi.wasmMemory.WriteString(uint32(ptr), s) {
+		panic(errFailedWrite)
+	}
+	return cString{
+		ptr:    ptr,
+		length: len(s),
+	}
+}
+
 func (abi *ahoCorasickABI) newOwnedCString(s string) cString {
 	res, err := abi.malloc.Call(context.Background(), uint64(len(s)))
 	if err != nil {
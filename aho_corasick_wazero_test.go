@@ -0,0 +1,222 @@
+//go:build !tinygo.wasm && !aho_corasick_cgo
+
+package aho_corasick
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// subprocessEnv is set when a test is run in a subprocess by runSubprocess.
+const subprocessEnv = "GO_AHO_CORASICK_TEST_SUBPROCESS"
+
+// runSubprocess runs the test named name in a new process with env added to its environment, for
+// tests of the runtime, which is initialized once per process.
+func runSubprocess(t *testing.T, name string, env ...string) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+name+"$", "-test.count=1")
+	cmd.Env = append(append(os.Environ(), subprocessEnv+"=1"), env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s failed: %v\n%s", name, err, out)
+	}
+}
+
+// checkRuntime checks that matchers can be built and searched in the runtime of the process.
+func checkRuntime(t *testing.T) {
+	t.Helper()
+
+	if err := Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup: %v", err)
+	}
+
+	ac := NewAhoCorasickBuilder(Opts{}).Build([]string{"bear", "masha"})
+	defer ac.Close()
+
+	got := ac.FindAll("The bear and masha")
+	want := []Match{{pattern: 0, start: 4, end: 8}, {pattern: 1, start: 13, end: 18}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("FindAll = %v, want %v", got, want)
+	}
+}
+
+func TestCompilationCache(t *testing.T) {
+	if os.Getenv(subprocessEnv) != "" {
+		checkRuntime(t)
+		return
+	}
+
+	dir := t.TempDir()
+	runSubprocess(t, t.Name(), compilationCacheDirEnv+"="+dir)
+
+	files := cacheFiles(t, dir)
+	if len(files) == 0 {
+		t.Fatal("expected the compiled module to be cached")
+	}
+
+	runSubprocess(t, t.Name(), compilationCacheDirEnv+"="+dir)
+
+	if got := cacheFiles(t, dir); !reflect.DeepEqual(got, files) {
+		t.Fatalf("expected the cached module to be reused, cache was %v and is %v", files, got)
+	}
+}
+
+func TestCompilationCache_Unusable(t *testing.T) {
+	if os.Getenv(subprocessEnv) != "" {
+		checkRuntime(t)
+		return
+	}
+
+	// A directory cannot be created below a regular file, so the module is compiled without the cache.
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runSubprocess(t, t.Name(), compilationCacheDirEnv+"="+filepath.Join(file, "cache"))
+}
+
+func TestCompilationCache_CustomConfig(t *testing.T) {
+	if os.Getenv(subprocessEnv) != "" {
+		SetRuntimeConfig(wazero.NewRuntimeConfig())
+		checkRuntime(t)
+		return
+	}
+
+	// A custom configuration is used as is, so the module is not cached in the directory.
+	dir := t.TempDir()
+	runSubprocess(t, t.Name(), compilationCacheDirEnv+"="+dir)
+
+	if files := cacheFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected the module not to be cached, cache is %v", files)
+	}
+}
+
+// cacheFiles returns the modification time of each file in the compilation cache in dir.
+func cacheFiles(t *testing.T, dir string) map[string]time.Time {
+	t.Helper()
+
+	files := map[string]time.Time{}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[path] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSetRuntimeConfig(t *testing.T) {
+	if os.Getenv(subprocessEnv) == "" {
+		runSubprocess(t, t.Name())
+		return
+	}
+
+	SetRuntimeConfig(wazero.NewRuntimeConfigInterpreter())
+	checkRuntime(t)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected SetRuntimeConfig to panic after building a matcher")
+		}
+	}()
+	SetRuntimeConfig(wazero.NewRuntimeConfig())
+}
+
+func TestSetRuntime(t *testing.T) {
+	if os.Getenv(subprocessEnv) == "" {
+		runSubprocess(t, t.Name())
+		return
+	}
+
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+
+	SetRuntime(rt)
+	checkRuntime(t)
+	if wasmRT != rt {
+		t.Fatal("expected matchers to be instantiated in the runtime")
+	}
+}
+
+func TestSetRuntime_WASI(t *testing.T) {
+	if os.Getenv(subprocessEnv) == "" {
+		runSubprocess(t, t.Name())
+		return
+	}
+
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+
+	SetRuntime(rt)
+	checkRuntime(t)
+	if wasmRT != rt {
+		t.Fatal("expected matchers to be instantiated in the runtime")
+	}
+}
+
+func TestShareModule_Trap(t *testing.T) {
+	if os.Getenv(subprocessEnv) == "" {
+		runSubprocess(t, t.Name())
+		return
+	}
+
+	// The memory of the module is limited, so building a large automaton runs out of it.
+	SetRuntimeConfig(wazero.NewRuntimeConfig().WithMemoryLimitPages(64))
+
+	builder := NewAhoCorasickBuilder(Opts{ShareModule: true})
+	small := builder.Build([]string{"bear", "masha"})
+
+	r := rand.New(rand.NewSource(1))
+	patterns := make([]string, 5000)
+	pattern := make([]byte, 100)
+	for i := range patterns {
+		r.Read(pattern)
+		patterns[i] = string(pattern)
+	}
+	_, err := builder.BuildE(patterns)
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) || buildErr.Kind != TrapError {
+		t.Fatalf("expected a BuildError of kind TrapError got %v", err)
+	}
+
+	// Matchers built afterwards use a new module.
+	next := builder.Build([]string{"bear", "masha"})
+	defer next.Close()
+	if next.abi == small.abi {
+		t.Fatal("expected a new module after the trap")
+	}
+	if matches := next.FindAll("The bear and masha"); len(matches) != 2 {
+		t.Errorf("unexpected matches %v", matches)
+	}
+
+	if small.abi.closed {
+		t.Fatal("expected the module to stay open while a matcher uses it")
+	}
+	if err := small.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !small.abi.closed {
+		t.Error("expected the module to be closed with its last matcher")
+	}
+}
@@ -3,55 +3,305 @@
 
 extern crate aho_corasick;
 
+use std::collections::{HashMap, HashSet};
+use std::fmt;
+use std::mem;
 use std::slice;
-use std::str;
-use aho_corasick::{AhoCorasick, AhoCorasickBuilder, AhoCorasickKind, FindIter, FindOverlappingIter, MatchKind};
+use std::sync::OnceLock;
+use aho_corasick::{AhoCorasick, AhoCorasickBuilder, AhoCorasickKind, Anchored, FindIter, FindOverlappingIter, Input, Match, MatchKind, StartKind};
+
+/// An automaton built from patterns along with the automaton finding all matches starting at a
+/// position, which is only needed for leftmost semantics when matches must be whole words.
+pub struct Matcher {
+    ac: AhoCorasick,
+    prefixes: Option<Prefixes>,
+}
+
+/// The automaton finding all matches starting at a position, which is built from a copy of the
+/// patterns the first time a match that is not a whole word may hide others.
+struct Prefixes {
+    patterns: Vec<Vec<u8>>,
+    ascii_case_insensitive: bool,
+    ac: OnceLock<Option<AhoCorasick>>,
+}
+
+impl Prefixes {
+    fn get(&self) -> Option<&AhoCorasick> {
+        self.ac.get_or_init(|| {
+            // Matches starting at the same position are all found with standard semantics.
+            AhoCorasickBuilder::new()
+                .ascii_case_insensitive(self.ascii_case_insensitive)
+                .build(&self.patterns)
+                .ok()
+        }).as_ref()
+    }
+
+    fn memory_usage(&self) -> usize {
+        let mut usage = self.patterns.capacity() * mem::size_of::<Vec<u8>>();
+        for pattern in &self.patterns {
+            usage += pattern.capacity();
+        }
+        if let Some(Some(ac)) = self.ac.get() {
+            usage += ac.memory_usage();
+        }
+        return usage;
+    }
+}
 
 #[no_mangle]
-pub extern "C" fn new_matcher(patterns_ptr: usize, patterns_len: *const usize, num_patterns: usize, ascii_case_insensitive: bool, dfa: bool, match_kind: MatchKind) -> Box<AhoCorasick> {
+pub extern "C" fn new_matcher(patterns_ptr: usize, patterns_len: *const usize, num_patterns: usize, ascii_case_insensitive: bool, kind: usize, match_kind: MatchKind, start_kind: usize, dense_depth: usize, byte_classes: bool, max_memory: usize, prefixes: bool, error_ptr: &mut usize, error_len: &mut usize, error_kind: &mut usize) -> Option<Box<Matcher>> {
+    let patterns = read_patterns(patterns_ptr, patterns_len, num_patterns);
+
+    let start_kind = match start_kind {
+        1 => StartKind::Anchored,
+        2 => StartKind::Both,
+        _ => StartKind::Unanchored,
+    };
+
+    let mut ac = AhoCorasickBuilder::new();
+    ac
+        .ascii_case_insensitive(ascii_case_insensitive)
+        .match_kind(match_kind)
+        .start_kind(start_kind)
+        .byte_classes(byte_classes);
+    if dense_depth > 0 {
+        ac.dense_depth(dense_depth);
+    }
+
+    let mut kind = match kind {
+        1 => Some(AhoCorasickKind::NoncontiguousNFA),
+        2 => Some(AhoCorasickKind::ContiguousNFA),
+        3 => Some(AhoCorasickKind::DFA),
+        _ => None,
+    };
+
+    if max_memory > 0 {
+        // Same criteria as the automatic choice of the crate for trying a DFA.
+        let dfa = match kind {
+            Some(AhoCorasickKind::DFA) => true,
+            None => start_kind != StartKind::Both && num_patterns <= 100,
+            _ => false,
+        };
+        // Building a DFA that is too large can run out of memory before it can be checked, so fall back
+        // to a contiguous NFA based on an estimate instead.
+        if dfa && estimate_dfa_memory(&patterns, ascii_case_insensitive, match_kind, byte_classes, start_kind == StartKind::Both) > max_memory {
+            kind = Some(AhoCorasickKind::ContiguousNFA);
+        }
+    }
+    ac.kind(kind);
+
+    let mut built = ac.build(&patterns);
+    if let Ok(dfa) = &built {
+        // The estimate only covers transitions, so the DFA can still exceed the limit.
+        if max_memory > 0 && dfa.memory_usage() > max_memory && dfa.kind() == AhoCorasickKind::DFA {
+            built = ac.kind(Some(AhoCorasickKind::ContiguousNFA)).build(&patterns);
+        }
+    }
+
+    let ac = match built {
+        Ok(ac) => ac,
+        Err(e) => {
+            write_error(e.to_string(), ERROR_BUILD, error_ptr, error_len, error_kind);
+            return None;
+        }
+    };
+
+    let prefixes = if prefixes {
+        Some(Prefixes {
+            patterns: patterns.iter().map(|p| p.to_vec()).collect(),
+            ascii_case_insensitive,
+            ac: OnceLock::new(),
+        })
+    } else {
+        None
+    };
+
+    let matcher = Matcher { ac, prefixes };
+    if max_memory > 0 && memory_usage(&matcher) > max_memory {
+        write_error(format!("automaton uses {} bytes of memory, exceeding the limit of {} bytes", memory_usage(&matcher), max_memory), ERROR_MAX_MEMORY, error_ptr, error_len, error_kind);
+        return None;
+    }
+    Some(Box::new(matcher))
+}
+
+fn read_patterns(patterns_ptr: usize, patterns_len: *const usize, num_patterns: usize) -> Vec<&'static [u8]> {
     let mut patterns = Vec::new();
 
     let mut off = 0usize;
     for i in 0..num_patterns {
         unsafe {
             let len = *patterns_len.offset(i as isize);
-            let pattern = ptr_to_string(patterns_ptr+off, len);
+            let pattern = ptr_to_bytes(patterns_ptr+off, len);
             patterns.push(pattern);
             off += len;
         }
     }
 
-    let mut ac = AhoCorasickBuilder::new();
-    ac
-        .ascii_case_insensitive(ascii_case_insensitive)
-        .match_kind(match_kind);
+    return patterns;
+}
 
-    if dfa {
-        ac.kind(Some(AhoCorasickKind::DFA));
+/// Returns an estimate of the number of states of the noncontiguous NFA built for the patterns, which
+/// the other kinds of automatons are built from. Patterns are not added past a match state with
+/// leftmost-first semantics, and the dead, fail and two start states are included.
+fn count_states(patterns: &[&[u8]], ascii_case_insensitive: bool, match_kind: MatchKind) -> usize {
+    let mut trie = HashMap::new();
+    let mut matches = HashSet::new();
+    'patterns: for pattern in patterns {
+        let mut state = 0usize;
+        for &b in pattern.iter() {
+            if match_kind == MatchKind::LeftmostFirst && matches.contains(&state) {
+                continue 'patterns;
+            }
+            // Both cases of a letter transition to the same state.
+            let b = if ascii_case_insensitive { b.to_ascii_lowercase() } else { b };
+            let next = trie.len() + 1;
+            state = *trie.entry((state, b)).or_insert(next);
+        }
+        matches.insert(state);
     }
 
-    return Box::new(ac.build(patterns).unwrap());
+    return trie.len() + 4;
+}
+
+/// The kinds of errors building a matcher, the same as the kinds of BuildError.
+const ERROR_BUILD: usize = 0;
+const ERROR_MAX_MEMORY: usize = 1;
+
+fn write_error(msg: String, kind: usize, error_ptr: &mut usize, error_len: &mut usize, error_kind: &mut usize) {
+    *error_kind = kind;
+    let b = msg.into_bytes().into_boxed_slice();
+    *error_len = b.len();
+    *error_ptr = Box::into_raw(b) as *mut u8 as usize;
+}
+
+/// Returns an upper bound of the memory used by the transitions of a DFA for the patterns, based on
+/// the number of states and the alphabet size after grouping bytes into classes.
+fn estimate_dfa_memory(patterns: &[&[u8]], ascii_case_insensitive: bool, match_kind: MatchKind, byte_classes: bool, both_starts: bool) -> usize {
+    // Both start kinds duplicate all states.
+    let mut states = count_states(patterns, ascii_case_insensitive, match_kind);
+    if both_starts {
+        states *= 2;
+    }
+
+    let mut used = [false; 256];
+    for pattern in patterns {
+        for &b in pattern.iter() {
+            used[b as usize] = true;
+            if ascii_case_insensitive {
+                used[b.to_ascii_uppercase() as usize] = true;
+                used[b.to_ascii_lowercase() as usize] = true;
+            }
+        }
+    }
+
+    // Each distinct byte splits at most two classes, and there is a class for the end of input.
+    let alphabet_len = if byte_classes {
+        std::cmp::min(2 * used.iter().filter(|&&u| u).count() + 1, 256) + 1
+    } else {
+        257
+    };
+
+    return states.saturating_mul(alphabet_len.next_power_of_two()).saturating_mul(4);
 }
 
 #[no_mangle]
-pub extern "C" fn delete_matcher(_matcher: Box<AhoCorasick>) {
+pub extern "C" fn error_delete(ptr: *mut u8, len: usize) {
+    unsafe {
+        let _ = Box::from_raw(slice::from_raw_parts_mut(ptr, len));
+    }
+}
+
+#[no_mangle]
+pub extern "C" fn delete_matcher(_matcher: Box<Matcher>) {
     // Box takes ownership and will release
 }
 
 #[no_mangle]
-pub extern "C" fn find_iter(ac: &AhoCorasick, value_ptr: usize, value_len: usize) -> Box<FindIter> {
-    let value = ptr_to_string(value_ptr, value_len);
+pub extern "C" fn memory_usage(matcher: &Matcher) -> usize {
+    let mut usage = matcher.ac.memory_usage();
+    if let Some(prefixes) = &matcher.prefixes {
+        usage += prefixes.memory_usage();
+    }
+    return usage;
+}
+
+/// Writes the kind, memory usage, state count, pattern count, minimum and maximum pattern length,
+/// match kind and whether a prefilter is used to stats_ptr.
+#[no_mangle]
+pub extern "C" fn matcher_stats(matcher: &Matcher, stats_ptr: *mut usize) {
+    let ac = &matcher.ac;
+    let stats = unsafe { slice::from_raw_parts_mut(stats_ptr, 8) };
+
+    let mut summary = Summary::default();
+    let _ = fmt::write(&mut summary, format_args!("{:?}", ac));
+
+    stats[0] = match ac.kind() {
+        AhoCorasickKind::NoncontiguousNFA => 1,
+        AhoCorasickKind::ContiguousNFA => 2,
+        AhoCorasickKind::DFA => 3,
+        _ => 0,
+    };
+    stats[1] = memory_usage(matcher);
+    stats[2] = summary.states;
+    stats[3] = ac.patterns_len();
+    stats[4] = ac.min_pattern_len();
+    stats[5] = ac.max_pattern_len();
+    stats[6] = match ac.match_kind() {
+        MatchKind::LeftmostFirst => 1,
+        MatchKind::LeftmostLongest => 2,
+        _ => 0,
+    };
+    stats[7] = summary.prefilter as usize;
+}
+
+/// The state count and whether a prefilter is used, which the automaton only exposes in its debug
+/// output. The output lists every state, so it is parsed line by line as it is written rather than
+/// kept.
+#[derive(Default)]
+struct Summary {
+    line: String,
+    states: usize,
+    prefilter: bool,
+}
+
+impl Summary {
+    fn parse_line(&mut self) {
+        let line = self.line.trim();
+        if let Some(v) = line.strip_prefix("state length: ") {
+            self.states = v.parse().unwrap_or(0);
+        } else if let Some(v) = line.strip_prefix("prefilter: ") {
+            self.prefilter = v == "true";
+        }
+        self.line.clear();
+    }
+}
+
+impl fmt::Write for Summary {
+    fn write_str(&mut self, s: &str) -> fmt::Result {
+        let mut s = s;
+        while let Some(i) = s.find('\n') {
+            self.line.push_str(&s[..i]);
+            self.parse_line();
+            s = &s[i+1..];
+        }
+        // Only the start of a line is needed to recognize it.
+        if self.line.len() < 64 {
+            self.line.push_str(s);
+        }
+        Ok(())
+    }
+}
+
+#[no_mangle]
+pub extern "C" fn find_iter(matcher: &Matcher, value_ptr: usize, value_len: usize) -> Box<FindIter> {
+    let ac = &matcher.ac;
+    let value = ptr_to_bytes(value_ptr, value_len);
     return Box::new(ac.find_iter(value));
 }
 
 #[no_mangle]
-pub extern "C" fn find_iter_next(iter: &mut FindIter, pattern: &mut usize, start: &mut usize, end: &mut usize) -> bool {
-    iter.next().map(|m| {
-        *pattern = m.pattern().as_usize();
-        *start = m.start();
-        *end = m.end();
-        true
-    }).unwrap_or(false)
+pub extern "C" fn find_iter_next_batch(iter: &mut FindIter, matches_ptr: *mut usize, limit: usize) -> usize {
+    return next_batch(iter, matches_ptr, limit);
 }
 
 #[no_mangle]
@@ -60,19 +310,15 @@ pub extern "C" fn find_iter_delete(_iter: Box<FindIter>) {
 }
 
 #[no_mangle]
-pub extern "C" fn overlapping_iter(ac: &AhoCorasick, value_ptr: usize, value_len: usize) -> Box<FindOverlappingIter> {
-    let value = ptr_to_string(value_ptr, value_len);
+pub extern "C" fn overlapping_iter(matcher: &Matcher, value_ptr: usize, value_len: usize) -> Box<FindOverlappingIter> {
+    let ac = &matcher.ac;
+    let value = ptr_to_bytes(value_ptr, value_len);
     return Box::new(ac.find_overlapping_iter(value));
 }
 
 #[no_mangle]
-pub extern "C" fn overlapping_iter_next(iter: &mut FindOverlappingIter, pattern: &mut usize, start: &mut usize, end: &mut usize) -> bool {
-    iter.next().map(|m| {
-        *pattern = m.pattern().as_usize();
-        *start = m.start();
-        *end = m.end();
-        true
-    }).unwrap_or(false)
+pub extern "C" fn overlapping_iter_next_batch(iter: &mut FindOverlappingIter, matches_ptr: *mut usize, limit: usize) -> usize {
+    return next_batch(iter, matches_ptr, limit);
 }
 
 #[no_mangle]
@@ -81,36 +327,101 @@ pub extern "C" fn overlapping_iter_delete(_iter: Box<FindOverlappingIter>) {
 }
 
 #[no_mangle]
-pub extern "C" fn matches(ac: &mut AhoCorasick, value_ptr: usize, value_len: usize, limit: usize, num: &mut usize) -> *const usize {
-    let mut matches = Vec::new();
-    let value = ptr_to_string(value_ptr, value_len);
+pub extern "C" fn is_match(matcher: &Matcher, value_ptr: usize, value_len: usize) -> bool {
+    let ac = &matcher.ac;
+    let value = ptr_to_bytes(value_ptr, value_len);
+    return ac.is_match(value);
+}
 
-    let mut count = 0;
-    for value in ac.find_iter(value.as_bytes()) {
-        if count == limit {
-            break;
+#[no_mangle]
+pub extern "C" fn find_anchored(matcher: &Matcher, value_ptr: usize, value_len: usize, pattern: &mut usize, start: &mut usize, end: &mut usize) -> bool {
+    let ac = &matcher.ac;
+    let value = ptr_to_bytes(value_ptr, value_len);
+    let input = Input::new(value).anchored(Anchored::Yes);
+    match ac.try_find(input) {
+        Ok(Some(m)) => {
+            *pattern = m.pattern().as_usize();
+            *start = m.start();
+            *end = m.end();
+            true
         }
+        _ => false,
+    }
+}
 
-        matches.push(value.pattern().as_usize());
-        matches.push(value.start());
-        matches.push(value.end());
+/// Writes the matches starting at the beginning of the value as pattern, start and end triples to
+/// matches_ptr, in the order the match kind of the matcher prefers them and skipping the first skip
+/// of them. This finds the matches leftmost semantics do not report, for example shorter matches
+/// when the longest one is not a whole word. The automaton finding them is built on the first call.
+#[no_mangle]
+pub extern "C" fn prefix_matches(matcher: &Matcher, value_ptr: usize, value_len: usize, skip: usize, matches_ptr: *mut usize, limit: usize) -> usize {
+    let value = ptr_to_bytes(value_ptr, value_len);
+    let prefixes = match matcher.prefixes.as_ref().and_then(|p| p.get()) {
+        Some(prefixes) => prefixes,
+        None => return 0,
+    };
 
-        count += 1;
+    // Overlapping searches cannot be anchored, so matches starting later are searched for too but only
+    // as far as the longest pattern.
+    let value = &value[..std::cmp::min(value.len(), prefixes.max_pattern_len())];
+    let mut found: Vec<Match> = prefixes.find_overlapping_iter(value).filter(|m| m.start() == 0).collect();
+    match matcher.ac.match_kind() {
+        MatchKind::LeftmostLongest => found.sort_by_key(|m| (std::cmp::Reverse(m.len()), m.pattern())),
+        _ => found.sort_by_key(|m| m.pattern()),
     }
 
-    let b = matches.into_boxed_slice();
-    let ptr = b.as_ptr();
-    let len = b.len(); // Same as count since into_boxed_slice() truncates
-    std::mem::forget(b);
-    *num = len;
-    return ptr;
+    return next_batch(&mut found.into_iter().skip(skip), matches_ptr, limit);
 }
 
+/// Writes up to limit of the matches found searching the value from start as pattern, start and end
+/// triples to matches_ptr, returning the number of matches written. Nothing is allocated, so a search
+/// continues with another call from the end of the last match written, with resume set to skip an
+/// empty match there the same as the iterator of the crate does.
 #[no_mangle]
-pub extern "C" fn matches_delete(ptr: *const usize, len: usize) {
-    unsafe {
-        let _ = Vec::from_raw_parts(ptr as *mut usize, len, len);
+pub extern "C" fn matches(matcher: &Matcher, value_ptr: usize, value_len: usize, start: usize, resume: bool, matches_ptr: *mut usize, limit: usize) -> usize {
+    let ac = &matcher.ac;
+    let value = ptr_to_bytes(value_ptr, value_len);
+
+    let mut input = Input::new(value).span(start..value.len());
+    let mut last_end = if resume { Some(start) } else { None };
+    let mut iter = std::iter::from_fn(|| {
+        let mut m = ac.find(input.clone())?;
+        if m.is_empty() && Some(m.end()) == last_end {
+            if input.start() == value.len() {
+                return None;
+            }
+            input.set_start(input.start() + 1);
+            m = ac.find(input.clone())?;
+        }
+        input.set_start(m.end());
+        last_end = Some(m.end());
+        Some(m)
+    });
+
+    return next_batch(&mut iter, matches_ptr, limit);
+}
+
+/// Writes up to limit matches from the iterator as pattern, start and end triples to matches_ptr,
+/// returning the number of matches written. Fewer than limit matches means the iterator is exhausted.
+fn next_batch<I: Iterator<Item = Match>>(iter: &mut I, matches_ptr: *mut usize, limit: usize) -> usize {
+    if limit == 0 {
+        return 0;
     }
+    let matches = unsafe { slice::from_raw_parts_mut(matches_ptr, limit * 3) };
+
+    let mut count = 0;
+    while count < limit {
+        match iter.next() {
+            Some(m) => {
+                matches[count * 3] = m.pattern().as_usize();
+                matches[count * 3 + 1] = m.start();
+                matches[count * 3 + 2] = m.end();
+                count += 1;
+            }
+            None => break,
+        }
+    }
+    return count;
 }
 
 extern "C" {
@@ -125,11 +436,14 @@ pub unsafe extern "C" fn __initialize() {
     __wasm_call_ctors()
 }
 
-/// Returns a string from WebAssembly compatible numeric types representing
-/// its pointer and length.
-fn ptr_to_string(ptr: usize, len: usize) -> &'static str {
+/// Returns a byte slice from WebAssembly compatible numeric types representing
+/// its pointer and length. Patterns and haystacks are not required to be UTF-8.
+fn ptr_to_bytes(ptr: usize, len: usize) -> &'static [u8] {
+    // Empty values may not be backed by any allocation.
+    if len == 0 {
+        return &[];
+    }
     unsafe {
-        let slice = slice::from_raw_parts(ptr as *mut u8, len as usize);
-        return str::from_utf8_unchecked(slice);
+        return slice::from_raw_parts(ptr as *mut u8, len as usize);
     }
 }
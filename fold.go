@@ -0,0 +1,165 @@
+package aho_corasick
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// mappedHaystack is the span of a haystack as it is searched, which may be rewritten for options
+// such as UnicodeCaseInsensitive or Normalization, along with what is needed to map positions back
+// to the haystack.
+type mappedHaystack struct {
+	s string
+	// start is the position of the span in the haystack.
+	start int
+	// offsets are the positions in the span of each position of s and its end, or nil if they are
+	// the same.
+	offsets []int
+	// ends are the positions in the span of each position of s and its end when it is the end of a
+	// match, or nil if they are the same as offsets.
+	ends []int
+}
+
+// mapHaystack returns the span of the haystack from start to end as it is searched.
+func (ac AhoCorasick) mapHaystack(haystack string, start int, end int) mappedHaystack {
+	h := mappedHaystack{s: haystack[start:end], start: start}
+	if f, ok := ac.normalization.form(); ok {
+		h.s, h.offsets, h.ends = normalize(f, h.s)
+	}
+	if ac.unicodeCaseInsensitive {
+		s, offsets := foldCase(h.s)
+		h.s = s
+		if offsets != nil {
+			h.remap(offsets)
+		}
+	}
+	return h
+}
+
+// remap updates the positions of h after rewriting s, offsets being the positions in s of each
+// position of the rewritten string and its end.
+func (h *mappedHaystack) remap(offsets []int) {
+	if h.offsets == nil {
+		h.offsets = offsets
+		return
+	}
+	starts := make([]int, len(offsets))
+	var ends []int
+	if h.ends != nil {
+		ends = make([]int, len(offsets))
+	}
+	for i, o := range offsets {
+		starts[i] = h.offsets[o]
+		if ends != nil {
+			ends[i] = h.ends[o]
+		}
+	}
+	h.offsets, h.ends = starts, ends
+}
+
+// maxMatchLen returns the maximum length in bytes of a match in a haystack, which is longer than the
+// longest pattern when haystacks are rewritten before searching.
+func (ac AhoCorasick) maxMatchLen() int {
+	if ac.unicodeCaseInsensitive {
+		// Folding makes a rune at most three times shorter, such as the Kelvin sign becoming "k".
+		return 3 * ac.maxPatternLen
+	}
+	return ac.maxPatternLen
+}
+
+// original returns the position in the haystack of position i of the searched span.
+func (h mappedHaystack) original(i int) int {
+	if h.offsets == nil {
+		return h.start + i
+	}
+	return h.start + h.offsets[i]
+}
+
+// originalEnd is like original for position i being the end of a match.
+func (h mappedHaystack) originalEnd(i int) int {
+	if h.ends == nil {
+		return h.original(i)
+	}
+	return h.start + h.ends[i]
+}
+
+// match returns m with positions in the haystack instead of the searched span.
+func (h mappedHaystack) match(m Match) *Match {
+	return &Match{pattern: m.pattern, start: h.original(m.start), end: h.originalEnd(m.end)}
+}
+
+// foldCase replaces each rune of s with the rune representing its Unicode simple case folding, see
+// foldRune. s is returned as is if no rune changes. Folding never makes a rune longer but can make it
+// shorter, in which case the positions in s of each position of the result and its end are returned
+// too. Invalid UTF-8 is kept as is.
+func foldCase(s string) (string, []int) {
+	var b []byte
+	var offsets []int
+	for i := 0; i < len(s); {
+		r, size := rune(s[i]), 1
+		if r >= utf8.RuneSelf {
+			r, size = utf8.DecodeRuneInString(s[i:])
+		}
+
+		f := foldRune(r)
+		if f == r {
+			if b != nil {
+				b = append(b, s[i:i+size]...)
+				for j := 0; offsets != nil && j < size; j++ {
+					offsets = append(offsets, i+j)
+				}
+			}
+			i += size
+			continue
+		}
+
+		if b == nil {
+			b = make([]byte, i, len(s))
+			copy(b, s)
+		}
+		fsize := utf8.RuneLen(f)
+		if fsize != size && offsets == nil {
+			// Positions are the same up to the first rune changing length.
+			offsets = make([]int, len(b), len(s)+1)
+			for j := range offsets {
+				offsets[j] = j
+			}
+		}
+		b = utf8.AppendRune(b, f)
+		for j := 0; offsets != nil && j < fsize; j++ {
+			offsets = append(offsets, i)
+		}
+		i += size
+	}
+
+	if b == nil {
+		return s, nil
+	}
+	if offsets != nil {
+		offsets = append(offsets, len(s))
+	}
+	return bytesToString(b), offsets
+}
+
+// foldRune returns the rune representing all runes equivalent to r under Unicode simple case folding,
+// which is the lowercase ASCII letter if there is one so that most text in ASCII does not change, or
+// the smallest rune otherwise.
+func foldRune(r rune) rune {
+	if r < utf8.RuneSelf {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}
+
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < utf8.RuneSelf {
+			return unicode.ToLower(f)
+		}
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
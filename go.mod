@@ -5,5 +5,7 @@ go 1.20
 require (
 	github.com/magefile/mage v1.14.0
 	github.com/petar-dambovaliev/aho-corasick v0.0.0-20211021192214-5ab2d9280aa9
+	github.com/rivo/uniseg v0.4.7
 	github.com/tetratelabs/wazero v1.7.2-0.20240506055917-3df6408adf73
+	golang.org/x/text v0.14.0
 )
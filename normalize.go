@@ -0,0 +1,80 @@
+package aho_corasick
+
+import (
+	"golang.org/x/text/unicode/norm"
+)
+
+type normalization int
+
+const (
+	// Patterns and haystacks are searched as is.
+	NoNormalization normalization = iota
+	// Patterns and haystacks are normalized to Unicode normalization form C before searching, so
+	// canonically equivalent text matches, for example "é" as one character or as "e" followed by
+	// a combining accent.
+	NFC
+	// Patterns and haystacks are normalized to Unicode normalization form KC before searching, which
+	// also matches compatibility equivalents, for example the ligature "ﬁ" matches "fi" and
+	// full-width letters match their ASCII counterparts.
+	NFKC
+)
+
+// form returns the normalization form applied to patterns and haystacks, and whether there is one.
+func (n normalization) form() (norm.Form, bool) {
+	switch n {
+	case NFC:
+		return norm.NFC, true
+	case NFKC:
+		return norm.NFKC, true
+	default:
+		return 0, false
+	}
+}
+
+// normalize returns s in normalization form f. s is returned as is if it is already normalized,
+// otherwise the positions in s of each position of the result and its end are returned too, for
+// positions at the start and at the end of matches respectively. Positions within a normalized
+// segment, such as a character and the combining marks following it, map to the start and to the
+// end of the segment in s, so a match covering part of a segment covers all of it.
+func normalize(f norm.Form, s string) (string, []int, []int) {
+	if f.IsNormalString(s) {
+		return s, nil, nil
+	}
+
+	b := make([]byte, 0, len(s))
+	starts := make([]int, 0, len(s)+1)
+	ends := make([]int, 0, len(s)+1)
+
+	var it norm.Iter
+	it.InitString(f, s)
+	start, out := 0, 0
+	for !it.Done() {
+		b = append(b, it.Next()...)
+		end := it.Pos()
+		if end == start {
+			// Long decompositions are returned in several parts before moving past the input.
+			continue
+		}
+
+		if string(b[out:]) == s[start:end] {
+			for i := start; i < end; i++ {
+				starts = append(starts, i)
+				ends = append(ends, i)
+			}
+		} else {
+			for i := out; i < len(b); i++ {
+				starts = append(starts, start)
+				if i == out {
+					ends = append(ends, start)
+				} else {
+					ends = append(ends, end)
+				}
+			}
+		}
+		start, out = end, len(b)
+	}
+
+	starts = append(starts, len(s))
+	ends = append(ends, len(s))
+	return bytesToString(b), starts, ends
+}
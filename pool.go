@@ -0,0 +1,93 @@
+package aho_corasick
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// matcherInstance is a copy of a matcher along with the module instance it was built in.
+type matcherInstance struct {
+	abi *ahoCorasickABI
+	ptr uintptr
+}
+
+// matcherPool holds copies of a matcher built in separate module instances so that searches from
+// multiple goroutines do not wait on each other. Copies are built when all existing ones are busy,
+// up to size copies.
+type matcherPool struct {
+	source *matcherSource
+
+	mu        sync.Mutex
+	instances []matcherInstance
+	size      int
+	building  int
+
+	next uint32
+}
+
+// startOperation starts an operation on an idle copy of the matcher, building a new copy if all are busy.
+func (p *matcherPool) startOperation(memorySize int) matcherInstance {
+	p.mu.Lock()
+	instances := p.instances
+	p.mu.Unlock()
+
+	for _, inst := range instances {
+		if inst.abi.tryStartOperation(memorySize) {
+			return inst
+		}
+	}
+
+	if inst, ok := p.grow(); ok {
+		inst.abi.startOperation(memorySize)
+		return inst
+	}
+
+	// Wait for a busy copy, spreading waiting operations across them.
+	inst := instances[atomic.AddUint32(&p.next, 1)%uint32(len(instances))]
+	inst.abi.startOperation(memorySize)
+	return inst
+}
+
+// grow builds a new copy of the matcher, returning false if the pool is already full.
+func (p *matcherPool) grow() (matcherInstance, bool) {
+	p.mu.Lock()
+	if len(p.instances)+p.building >= p.size {
+		p.mu.Unlock()
+		return matcherInstance{}, false
+	}
+	p.building++
+	p.mu.Unlock()
+
+	abi, err := newABI()
+	var ptr uintptr
+	if err == nil {
+		ptr, err = p.source.builder.newMatcher(abi, p.source.patterns, p.source.patternBytes)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.building--
+	if err != nil {
+		// The patterns were already built once so this is likely running out of memory, stop growing.
+		p.size = len(p.instances)
+		return matcherInstance{}, false
+	}
+
+	inst := matcherInstance{abi: abi, ptr: ptr}
+	p.instances = append(p.instances, inst)
+	return inst, true
+}
+
+func (p *matcherPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var firstErr error
+	for _, inst := range p.instances {
+		if err := inst.abi.close(inst.ptr); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,220 @@
+package aho_corasick
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+// streamChunkSize is the amount of data read from a stream at a time, matching the
+// buffer size used for stream searches by the Rust library.
+const streamChunkSize = 64 * 1024
+
+var (
+	// ErrStreamUnsupportedMatchKind is returned when searching a stream with an automaton
+	// not built with StandardMatch semantics.
+	ErrStreamUnsupportedMatchKind = errors.New("aho_corasick: stream searching requires StandardMatch")
+	// ErrStreamUnsupportedEmpty is returned when searching a stream with an automaton
+	// that can match the empty string.
+	ErrStreamUnsupportedEmpty = errors.New("aho_corasick: stream searching does not support empty patterns")
+	// ErrStreamUnsupportedNormalization is returned when searching a stream with an automaton
+	// built with Normalization.
+	ErrStreamUnsupportedNormalization = errors.New("aho_corasick: stream searching does not support normalization")
+)
+
+// StreamIter is an iterator over matches found while reading a stream.
+// Once Next returns nil, Err reports whether the stream was fully searched.
+type StreamIter interface {
+	Iter
+	// Err returns the first error encountered while searching the stream, or nil if it
+	// was read until io.EOF.
+	Err() error
+}
+
+// StreamFind gives an iterator over the matches found while reading r. Offsets of matches are
+// relative to the beginning of the stream. Only a bounded window of the stream is kept in memory.
+// Matches are the same as reported by Iter over the entire contents of the stream, which requires
+// the automaton to be built with StandardMatch semantics, without empty patterns and without
+// Normalization.
+func (ac AhoCorasick) StreamFind(r io.Reader) StreamIter {
+	return ac.streamFind(r)
+}
+
+func (ac AhoCorasick) streamFind(r io.Reader) *streamIter {
+	ac.checkUnanchored()
+
+	s := &streamIter{ac: ac, r: r}
+	switch {
+	case ac.matchKind != StandardMatch:
+		s.err = ErrStreamUnsupportedMatchKind
+	case ac.minPatternLen == 0:
+		s.err = ErrStreamUnsupportedEmpty
+	case ac.normalization != NoNormalization:
+		s.err = ErrStreamUnsupportedNormalization
+	}
+	return s
+}
+
+type streamIter struct {
+	ac AhoCorasick
+	r  io.Reader
+
+	// buf holds the window of the stream currently being searched, starting at offset base
+	// of the stream. pos is the position in buf to resume searching from and bytes before
+	// discard are no longer needed once the matches found so far have been consumed.
+	buf     []byte
+	base    int
+	pos     int
+	discard int
+
+	matches []Match
+	eof     bool
+	err     error
+}
+
+// Next gives a pointer to the next match yielded by the iterator or nil, if there is none
+func (s *streamIter) Next() *Match {
+	for {
+		if len(s.matches) > 0 {
+			m := s.matches[0]
+			s.matches = s.matches[1:]
+			return &m
+		}
+		if s.done() {
+			return nil
+		}
+		s.advance()
+	}
+}
+
+func (s *streamIter) Err() error {
+	return s.err
+}
+
+// incompleteRuneStart returns the start of the rune at the end of b if it is incomplete, or len(b).
+func incompleteRuneStart(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+func (s *streamIter) done() bool {
+	return s.eof || s.err != nil
+}
+
+// Close stops reading the stream. Err returns ErrClosed if the stream was not fully searched.
+func (s *streamIter) Close() error {
+	if !s.done() {
+		s.err = ErrClosed
+	}
+	s.buf = nil
+	s.matches = nil
+	return nil
+}
+
+// advance reads the next chunk of the stream and appends the matches found in it.
+func (s *streamIter) advance() {
+	if !s.fill() {
+		return
+	}
+
+	if !s.ac.state.tryEnter() {
+		s.err = ErrClosed
+		return
+	}
+	defer s.ac.state.exit()
+
+	s.search()
+}
+
+// fill reads the next chunk of the stream into the buffer, returning whether there is
+// new data to search.
+func (s *streamIter) fill() bool {
+	n := copy(s.buf, s.buf[s.discard:])
+	s.buf = s.buf[:n]
+	s.base += s.discard
+	s.pos -= s.discard
+	s.discard = 0
+
+	if cap(s.buf)-len(s.buf) < streamChunkSize {
+		buf := make([]byte, len(s.buf), len(s.buf)+streamChunkSize)
+		copy(buf, s.buf)
+		s.buf = buf
+	}
+
+	n, err := s.r.Read(s.buf[len(s.buf):cap(s.buf)])
+	s.buf = s.buf[:len(s.buf)+n]
+	switch {
+	case err == io.EOF:
+		s.eof = true
+		return true
+	case err != nil:
+		s.err = err
+		return false
+	}
+	return n > 0
+}
+
+// search finds the matches in the unsearched part of the buffer that cannot be affected
+// by data later in the stream and marks the part of the buffer no longer needed.
+func (s *streamIter) search() {
+	haystack := bytesToString(s.buf)
+	// Whole word filtering is done here since it needs the bytes surrounding the searched
+	// part of the buffer.
+	found := s.ac.search(haystack, s.pos, len(s.buf), -1, nil)
+	words := s.ac.wordFilter(haystack)
+
+	// With standard semantics, a match is reported as soon as its end is seen, so the same
+	// matches are found when resuming from any point not after the end of the previous match.
+	keep := s.pos
+	deferred := false
+	for _, m := range found {
+		keep = m.end
+		if words != nil {
+			if len(s.buf)-m.end < words.context() && !s.eof {
+				// Whether the match is a whole word depends on the next bytes which have not been
+				// read yet, search again from the start of the match with more data.
+				keep = m.start
+				deferred = true
+				break
+			}
+			if words.isNotWholeWord(m.start, m.end) {
+				continue
+			}
+		}
+		m.start += s.base
+		m.end += s.base
+		s.matches = append(s.matches, m)
+	}
+
+	if s.eof {
+		s.pos = len(s.buf)
+		return
+	}
+
+	// A match starting before the last max match length - 1 bytes would already have been found.
+	if tail := len(s.buf) - (s.ac.maxMatchLen() - 1); !deferred && keep < tail {
+		keep = tail
+	}
+	if s.ac.unicodeCaseInsensitive {
+		// A rune split at the end of the buffer can only be folded once the rest of it is read.
+		if start := incompleteRuneStart(s.buf); keep > start {
+			keep = start
+		}
+	}
+	s.pos = keep
+	// Keep the bytes before it needed for checking word boundaries.
+	s.discard = keep
+	if s.ac.matchOnlyWholeWords {
+		s.discard -= s.ac.wordBoundaries.context()
+	}
+	if s.discard < 0 {
+		s.discard = 0
+	}
+}
@@ -47,7 +47,7 @@ func (o *pm) Evaluate(tx rules.TransactionState, value string) bool {
 func pmEvaluate(matcher ahocorasick.AhoCorasick, tx rules.TransactionState, value string) bool {
 	if !tx.Capturing() {
 		// Not capturing so just one match is enough.
-		return len(matcher.FindN(value, 1)) > 0
+		return matcher.IsMatch(value)
 	}
 
 	var numMatches int
@@ -0,0 +1,143 @@
+package aho_corasick
+
+import (
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+type wordBoundary int
+
+const (
+	// Matches are whole words when not preceded or followed by a letter, digit or combining mark.
+	LetterDigitBoundary wordBoundary = iota
+	// Matches are whole words when not preceded or followed by a letter, decimal digit, combining
+	// mark or connector punctuation such as underscore, like \b in Unicode-aware regular expressions.
+	RegexpBoundary
+	// Matches are whole words when they start and end at word boundaries as defined by Unicode text
+	// segmentation (UAX #29), which for example keeps contractions like "can't" as one word.
+	UnicodeBoundary
+)
+
+// wordSegmentContext is the number of bytes around a match searched streams keep to find word
+// boundaries with Unicode text segmentation. Segmentation rules can look further than this in
+// rare cases, such as long sequences of regional indicators.
+const wordSegmentContext = 64
+
+// wordBoundaries decides whether matches are whole words. The runes preceding and following a
+// match are checked with isLeftWordRune and isRightWordRune, or with Unicode text segmentation
+// if they are nil.
+type wordBoundaries struct {
+	isLeftWordRune  func(r rune) bool
+	isRightWordRune func(r rune) bool
+}
+
+func newWordBoundaries(o Opts) wordBoundaries {
+	var isWordRune func(r rune) bool
+	switch o.WordBoundary {
+	case RegexpBoundary:
+		isWordRune = isRegexpWordRune
+	case UnicodeBoundary:
+	default:
+		isWordRune = isLetterDigitRune
+	}
+	if o.IsWordRune != nil {
+		isWordRune = o.IsWordRune
+	}
+
+	w := wordBoundaries{isLeftWordRune: isWordRune, isRightWordRune: isWordRune}
+	if o.IsLeftWordRune != nil {
+		w.isLeftWordRune = o.IsLeftWordRune
+	}
+	if o.IsRightWordRune != nil {
+		w.isRightWordRune = o.IsRightWordRune
+	}
+	return w
+}
+
+// context returns the number of bytes around a match needed to decide whether it is a whole word.
+func (w wordBoundaries) context() int {
+	if w.isLeftWordRune == nil || w.isRightWordRune == nil {
+		return wordSegmentContext
+	}
+	return utf8.UTFMax
+}
+
+// filter returns a wordFilter for matches in the haystack.
+func (w wordBoundaries) filter(haystack string) *wordFilter {
+	return &wordFilter{wordBoundaries: w, haystack: haystack, state: -1}
+}
+
+// wordFilter checks whether matches in a haystack are whole words.
+type wordFilter struct {
+	wordBoundaries
+	haystack string
+
+	// boundaries are the word boundaries found by Unicode text segmentation of the haystack up
+	// to pos, which is only done as far as needed by the matches checked so far.
+	boundaries []int
+	pos        int
+	state      int
+}
+
+// isNotWholeWord returns whether the match at start and end is not a whole word, decoding the
+// neighbouring runes as UTF-8.
+func (f *wordFilter) isNotWholeWord(start int, end int) bool {
+	if !f.canStart(start) {
+		return true
+	}
+
+	if f.isRightWordRune == nil {
+		if !f.isBoundary(end) {
+			return true
+		}
+	} else if end < len(f.haystack) {
+		if r, _ := utf8.DecodeRuneInString(f.haystack[end:]); f.isRightWordRune(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canStart returns whether a match starting at i can be a whole word.
+func (f *wordFilter) canStart(i int) bool {
+	if f.isLeftWordRune == nil {
+		return f.isBoundary(i)
+	}
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(f.haystack[:i])
+	return !f.isLeftWordRune(r)
+}
+
+// isBoundary returns whether i is a word boundary of the haystack as defined by Unicode text segmentation.
+func (f *wordFilter) isBoundary(i int) bool {
+	if i == 0 || i == len(f.haystack) {
+		return true
+	}
+
+	for f.pos < i {
+		word, _, state := uniseg.FirstWordInString(f.haystack[f.pos:], f.state)
+		f.pos += len(word)
+		f.state = state
+		f.boundaries = append(f.boundaries, f.pos)
+	}
+
+	idx := sort.SearchInts(f.boundaries, i)
+	return idx < len(f.boundaries) && f.boundaries[idx] == i
+}
+
+// isLetterDigitRune returns whether r is part of a word, which is a letter, a digit or a combining
+// mark such as an accent following a letter. Invalid UTF-8 is never part of a word.
+func isLetterDigitRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// isRegexpWordRune returns whether r is a word character of Unicode-aware regular expressions.
+func isRegexpWordRune(r rune) bool {
+	return isLetterDigitRune(r) || unicode.Is(unicode.Pc, r)
+}